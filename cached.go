@@ -0,0 +1,447 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
+const (
+	DefaultCacheTTL = 60 * time.Second
+
+	// InvalidateAllKeys is published in place of a key when every cached
+	// entry must be discarded (e.g. after a full Update or Clear).
+	InvalidateAllKeys = "*"
+)
+
+var ErrInvalidCacheSize = errors.New("invalid cache size (must be > 0)")
+
+type lruEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// LRUCache is a bounded, least-recently-used cache of lookups whose entries
+// expire after a fixed TTL.
+type LRUCache struct {
+	size       int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+	lock       sync.Mutex
+}
+
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (cache *LRUCache) Get(key string) (bool, bool) {
+	value, ok := cache.getValue(key)
+	if !ok {
+		return false, false
+	}
+
+	return value.(bool), true
+}
+
+func (cache *LRUCache) getValue(key string) (interface{}, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		cache.order.Remove(elem)
+		delete(cache.entries, key)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// Generation returns a number that changes whenever an entry is removed or the
+// cache is purged.
+func (cache *LRUCache) Generation() uint64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.generation
+}
+
+// SetIfGeneration sets key unless the cache has been invalidated since the
+// given generation, in which case match may already be stale.
+func (cache *LRUCache) SetIfGeneration(key string, match bool, generation uint64) {
+	cache.setValueIfGeneration(key, match, generation)
+}
+
+func (cache *LRUCache) setValueIfGeneration(key string, value interface{}, generation uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.generation != generation {
+		return
+	}
+
+	cache.set(key, value)
+}
+
+func (cache *LRUCache) Set(key string, match bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.set(key, match)
+}
+
+// set must be called with the lock held.
+func (cache *LRUCache) set(key string, value interface{}) {
+	expiresAt := time.Now().Add(cache.ttl)
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		cache.order.MoveToFront(elem)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	if cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *LRUCache) Remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	if elem, ok := cache.entries[key]; ok {
+		cache.order.Remove(elem)
+		delete(cache.entries, key)
+	}
+}
+
+func (cache *LRUCache) Purge() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+}
+
+type CachedRepositoryConfig struct {
+	Size       int
+	TTL        time.Duration
+	Repository IRepository
+}
+
+// CachedRepository caches the lookups made by checks in front of another
+// IRepository. Writes made elsewhere are applied with Invalidate.
+type CachedRepository struct {
+	repository IRepository
+	cache      *LRUCache
+	usersets   *LRUCache
+	policies   *LRUCache
+}
+
+func NewCachedRepository(config CachedRepositoryConfig) (*CachedRepository, error) {
+	if config.Size <= 0 {
+		return nil, ErrInvalidCacheSize
+	}
+
+	ttl := DefaultCacheTTL
+	if config.TTL != 0 {
+		ttl = config.TTL
+	}
+
+	return &CachedRepository{
+		repository: config.Repository,
+		cache:      NewLRUCache(config.Size, ttl),
+		usersets:   NewLRUCache(config.Size, ttl),
+		policies:   NewLRUCache(config.Size, ttl),
+	}, nil
+}
+
+func (repo *CachedRepository) Get(key WarrantKey) (bool, error) {
+	if match, ok := repo.cache.Get(key.String()); ok {
+		return match, nil
+	}
+
+	// don't cache a result invalidated while it was being read
+	generation := repo.cache.Generation()
+	match, err := repo.repository.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	repo.cache.SetIfGeneration(key.String(), match, generation)
+	return match, nil
+}
+
+func (repo *CachedRepository) GetMany(keys []WarrantKey) ([]bool, error) {
+	matches := make([]bool, len(keys))
+	missIndexes := make([]int, 0)
+	missKeys := make([]WarrantKey, 0)
+	for i, key := range keys {
+		match, ok := repo.cache.Get(key.String())
+		if ok {
+			matches[i] = match
+			continue
+		}
+
+		missIndexes = append(missIndexes, i)
+		missKeys = append(missKeys, key)
+	}
+
+	if len(missKeys) == 0 {
+		return matches, nil
+	}
+
+	generation := repo.cache.Generation()
+	missMatches, err := repo.repository.GetMany(missKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, match := range missMatches {
+		matches[missIndexes[i]] = match
+		repo.cache.SetIfGeneration(missKeys[i].String(), match, generation)
+	}
+
+	return matches, nil
+}
+
+func (repo *CachedRepository) GetUsersets(objectRelations []string) ([][]SubjectKey, error) {
+	usersets := make([][]SubjectKey, len(objectRelations))
+	missIndexes := make([]int, 0)
+	missObjectRelations := make([]string, 0)
+	for i, objectRelation := range objectRelations {
+		value, ok := repo.usersets.getValue(objectRelation)
+		if ok {
+			usersets[i] = value.([]SubjectKey)
+			continue
+		}
+
+		missIndexes = append(missIndexes, i)
+		missObjectRelations = append(missObjectRelations, objectRelation)
+	}
+
+	if len(missObjectRelations) == 0 {
+		return usersets, nil
+	}
+
+	generation := repo.usersets.Generation()
+	missUsersets, err := repo.repository.GetUsersets(missObjectRelations)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, userset := range missUsersets {
+		usersets[missIndexes[i]] = userset
+		repo.usersets.setValueIfGeneration(missObjectRelations[i], userset, generation)
+	}
+
+	return usersets, nil
+}
+
+func (repo *CachedRepository) GetPolicies(keys []WarrantKey) ([][]warrant.Policy, error) {
+	policies := make([][]warrant.Policy, len(keys))
+	missIndexes := make([]int, 0)
+	missKeys := make([]WarrantKey, 0)
+	for i, key := range keys {
+		value, ok := repo.policies.getValue(key.String())
+		if ok {
+			policies[i] = value.([]warrant.Policy)
+			continue
+		}
+
+		missIndexes = append(missIndexes, i)
+		missKeys = append(missKeys, key)
+	}
+
+	if len(missKeys) == 0 {
+		return policies, nil
+	}
+
+	generation := repo.policies.Generation()
+	missPolicies, err := repo.repository.GetPolicies(missKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, keyPolicies := range missPolicies {
+		policies[missIndexes[i]] = keyPolicies
+		repo.policies.setValueIfGeneration(missKeys[i].String(), keyPolicies, generation)
+	}
+
+	return policies, nil
+}
+
+func (repo *CachedRepository) ListObjects(objectType string, relation string, subject SubjectKey, after string, limit int) ([]string, error) {
+	return repo.repository.ListObjects(objectType, relation, subject, after, limit)
+}
+
+func (repo *CachedRepository) ListSubjects(objectType string, objectId string, relation string, after string, limit int) ([]SubjectKey, error) {
+	return repo.repository.ListSubjects(objectType, objectId, relation, after, limit)
+}
+
+func (repo *CachedRepository) Range(fn func(key WarrantKey, count uint16) error) error {
+	exportable, ok := repo.repository.(IExportableRepository)
+	if !ok {
+		return ErrExportNotSupported
+	}
+
+	return exportable.Range(fn)
+}
+
+func (repo *CachedRepository) Set(key WarrantKey, count uint16) error {
+	defer repo.Invalidate(key.String())
+	return repo.repository.Set(key, count)
+}
+
+func (repo *CachedRepository) Incr(key WarrantKey) error {
+	defer repo.Invalidate(key.String())
+	return repo.repository.Incr(key)
+}
+
+func (repo *CachedRepository) Decr(key WarrantKey) error {
+	defer repo.Invalidate(key.String())
+	return repo.repository.Decr(key)
+}
+
+func (repo *CachedRepository) Update(warrants WarrantSet) error {
+	defer repo.Invalidate(InvalidateAllKeys)
+	return repo.repository.Update(warrants)
+}
+
+func (repo *CachedRepository) ApplyDelta(delta Delta) error {
+	defer repo.Invalidate(InvalidateAllKeys)
+	deltas, ok := repo.repository.(IDeltaRepository)
+	if !ok {
+		return ErrDeltasNotSupported
+	}
+
+	return deltas.ApplyDelta(delta)
+}
+
+func (repo *CachedRepository) Load() (IRepositoryLoader, error) {
+	loader, err := repo.repository.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedLoader{
+		IRepositoryLoader: loader,
+		repo:              repo,
+	}, nil
+}
+
+func (repo *CachedRepository) Clear() error {
+	defer repo.Invalidate(InvalidateAllKeys)
+	return repo.repository.Clear()
+}
+
+func (repo *CachedRepository) SetReady(isReady bool) {
+	repo.repository.SetReady(isReady)
+}
+
+func (repo *CachedRepository) Ready() bool {
+	return repo.repository.Ready()
+}
+
+func (repo *CachedRepository) SetLastSynced(lastSynced time.Time) error {
+	return repo.repository.SetLastSynced(lastSynced)
+}
+
+func (repo *CachedRepository) LastSynced() (time.Time, error) {
+	return repo.repository.LastSynced()
+}
+
+func (repo *CachedRepository) Version() (uint64, error) {
+	return repo.repository.Version()
+}
+
+func (repo *CachedRepository) Datastore() string {
+	return fmt.Sprintf("%s (cached)", repo.repository.Datastore())
+}
+
+// Invalidate discards the cached results for the encoded key, or all of them
+// for InvalidateAllKeys.
+func (repo *CachedRepository) Invalidate(key string) {
+	if key == InvalidateAllKeys {
+		repo.cache.Purge()
+		repo.usersets.Purge()
+		repo.policies.Purge()
+		return
+	}
+
+	repo.cache.Remove(key)
+
+	warrantKey, err := ParseWarrantKey(key)
+	if err != nil {
+		// don't keep anything the key may have belonged to
+		repo.usersets.Purge()
+		repo.policies.Purge()
+		return
+	}
+
+	if warrantKey.Policy != "" {
+		repo.policies.Remove(warrantKey.WithoutPolicy().String())
+	} else if warrantKey.IsUserset() {
+		repo.usersets.Remove(warrantKey.ObjectRelation())
+	}
+}
+
+// cachedLoader invalidates the local cache once the warrants it loaded are
+// committed.
+type cachedLoader struct {
+	IRepositoryLoader
+	repo *CachedRepository
+}
+
+func (loader *cachedLoader) Commit() error {
+	defer loader.repo.Invalidate(InvalidateAllKeys)
+	return loader.IRepositoryLoader.Commit()
+}
+
+func (loader *cachedLoader) CommitVersion(baseVersion uint64, version uint64, syncedAt time.Time) error {
+	defer loader.repo.Invalidate(InvalidateAllKeys)
+	return loader.IRepositoryLoader.CommitVersion(baseVersion, version, syncedAt)
+}
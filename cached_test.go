@@ -0,0 +1,128 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"testing"
+
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
+// countingRepository counts the lookups that reach the repository behind a
+// cache.
+type countingRepository struct {
+	IRepository
+	warrantLookups int
+	usersetLookups int
+	policyLookups  int
+}
+
+func (repo *countingRepository) GetMany(keys []WarrantKey) ([]bool, error) {
+	repo.warrantLookups++
+	return repo.IRepository.GetMany(keys)
+}
+
+func (repo *countingRepository) GetUsersets(objectRelations []string) ([][]SubjectKey, error) {
+	repo.usersetLookups++
+	return repo.IRepository.GetUsersets(objectRelations)
+}
+
+func (repo *countingRepository) GetPolicies(keys []WarrantKey) ([][]warrant.Policy, error) {
+	repo.policyLookups++
+	return repo.IRepository.GetPolicies(keys)
+}
+
+func TestCachedUsersetsAndPolicies(t *testing.T) {
+	counting := &countingRepository{IRepository: NewMemoryRepository()}
+	repo, err := NewCachedRepository(CachedRepositoryConfig{
+		Size:       10,
+		Repository: counting,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userset := WarrantKey{
+		ObjectType: "document",
+		ObjectId:   "1",
+		Relation:   "viewer",
+		Subject:    SubjectKey{ObjectType: "group", ObjectId: "eng", Relation: "member"},
+	}
+	policy := benchmarkKey(1)
+	policy.Policy = `tenant == "acme"`
+
+	expectUsersets := func(expected int, lookups int) {
+		t.Helper()
+
+		usersets, err := repo.GetUsersets([]string{userset.ObjectRelation()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(usersets[0]) != expected {
+			t.Fatalf("expected %d usersets, got %v", expected, usersets[0])
+		}
+		if counting.usersetLookups != lookups {
+			t.Fatalf("expected %d userset lookups, got %d", lookups, counting.usersetLookups)
+		}
+	}
+
+	expectPolicies := func(expected int, lookups int) {
+		t.Helper()
+
+		policies, err := repo.GetPolicies([]WarrantKey{policy.WithoutPolicy()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(policies[0]) != expected {
+			t.Fatalf("expected %d policies, got %v", expected, policies[0])
+		}
+		if counting.policyLookups != lookups {
+			t.Fatalf("expected %d policy lookups, got %d", lookups, counting.policyLookups)
+		}
+	}
+
+	expectUsersets(0, 1)
+	expectUsersets(0, 1)
+	expectPolicies(0, 1)
+	expectPolicies(0, 1)
+
+	// writes through the cache invalidate the usersets and policies they
+	// belong to
+	err = repo.Incr(userset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Incr(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUsersets(1, 2)
+	expectUsersets(1, 2)
+	expectPolicies(1, 2)
+	expectPolicies(1, 2)
+
+	// as do writes made elsewhere once they're invalidated
+	err = counting.Decr(userset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUsersets(1, 2)
+	repo.Invalidate(userset.String())
+	expectUsersets(0, 3)
+	expectPolicies(1, 2)
+
+	repo.Invalidate(InvalidateAllKeys)
+	expectPolicies(1, 3)
+}
@@ -0,0 +1,460 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+	"github.com/warrant-dev/warrant/pkg/service"
+)
+
+// CheckResult is the result of a check, optionally annotated with details of
+// how the edge agent arrived at it when the check was made in debug mode.
+type CheckResult struct {
+	check.CheckResultSpec
+	Debug *CheckDebugSpec `json:"debug,omitempty"`
+}
+
+type CheckDebugSpec struct {
+	Warrants       []WarrantMatchSpec `json:"warrants"`
+	Datastore      string             `json:"datastore"`
+	DecisionSource string             `json:"decisionSource"`
+	LastSyncedAt   *time.Time         `json:"lastSyncedAt,omitempty"`
+	CacheAge       int64              `json:"cacheAge,omitempty"`
+}
+
+// WarrantMatchSpec is the key looked up in the repository for one of the
+// warrants in a check and whether it was found.
+type WarrantMatchSpec struct {
+	Key   string `json:"key"`
+	Match bool   `json:"match"`
+}
+
+// checkMany evaluates a check, forwarding it upstream if it can't be
+// authorized locally, and returns the result along with its source.
+func (server *Server) checkMany(ctx context.Context, checkManySpec check.CheckManySpec) (CheckResult, string, error) {
+	start := time.Now()
+	err := validateCheckManySpec(checkManySpec)
+	if err != nil {
+		return CheckResult{}, "", err
+	}
+
+	var matches []bool
+	var localResult *check.CheckResultSpec
+	scopeErr := server.checkScope(checkManySpec.Warrants)
+	if scopeErr == nil && server.repository(ctx).Ready() {
+		matches, err = server.getMatches(ctx, checkManySpec.Warrants)
+		var outOfScopeErr *ObjectTypeOutOfScope
+		var notResolvableErr *UsersetNotResolvable
+		if errors.As(err, &outOfScopeErr) || errors.As(err, &notResolvableErr) {
+			scopeErr = err
+		} else if err != nil {
+			return CheckResult{}, "", err
+		} else {
+			checkResult := evaluateCheckManySpec(checkManySpec, matches)
+			localResult = &checkResult
+		}
+	}
+
+	if server.shouldCheckUpstream(ctx, localResult) {
+		upstreamResult, err := server.upstream(ctx).Check(ctx, checkManySpec)
+		if err == nil {
+			return server.newCheckResult(ctx, checkManySpec, *upstreamResult, matches, DecisionSourceUpstream, start), DecisionSourceUpstream, nil
+		}
+
+		log.Println(errors.Wrap(err, "error checking upstream"))
+	}
+
+	if scopeErr != nil {
+		return CheckResult{}, "", scopeErr
+	}
+
+	if localResult == nil {
+		return CheckResult{}, "", NewCacheNotReady()
+	}
+
+	return server.newCheckResult(ctx, checkManySpec, *localResult, matches, DecisionSourceCache, start), DecisionSourceCache, nil
+}
+
+// batchCheckMany evaluates several independent checks, returning their results
+// in order.
+func (server *Server) batchCheckMany(ctx context.Context, checkManySpecs []check.CheckManySpec) ([]CheckResult, error) {
+	start := time.Now()
+	if !server.repository(ctx).Ready() {
+		return nil, NewCacheNotReady()
+	}
+
+	if len(checkManySpecs) == 0 {
+		return nil, service.NewInvalidRequestError("Request must contain at least one check")
+	}
+
+	if len(checkManySpecs) > MaxBatchChecks {
+		return nil, service.NewInvalidRequestError(fmt.Sprintf("Request must contain at most %d checks", MaxBatchChecks))
+	}
+
+	// look up the warrants of every check in one read that bypasses the local
+	// cache; usersets and policies are separate reads
+	ctx = withoutLocalCache(ctx)
+	warrants := make([]check.CheckWarrantSpec, 0)
+	for i := range checkManySpecs {
+		err := service.ValidateStruct(ctx, &checkManySpecs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		err = validateCheckManySpec(checkManySpecs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		err = server.checkScope(checkManySpecs[i].Warrants)
+		if err != nil {
+			return nil, err
+		}
+
+		warrants = append(warrants, checkManySpecs[i].Warrants...)
+	}
+
+	matches, err := server.getMatches(ctx, warrants)
+	if err != nil {
+		return nil, err
+	}
+
+	checkResults := make([]CheckResult, len(checkManySpecs))
+	offset := 0
+	for i, checkManySpec := range checkManySpecs {
+		checkMatches := matches[offset : offset+len(checkManySpec.Warrants)]
+		checkResults[i] = server.newCheckResult(ctx, checkManySpec, evaluateCheckManySpec(checkManySpec, checkMatches), checkMatches, DecisionSourceCache, start)
+		offset += len(checkManySpec.Warrants)
+	}
+
+	return checkResults, nil
+}
+
+// newCheckResult wraps the result of a check, adding debug information if the
+// check was made in debug mode.
+func (server *Server) newCheckResult(ctx context.Context, checkManySpec check.CheckManySpec, checkResultSpec check.CheckResultSpec, matches []bool, decisionSource string, start time.Time) CheckResult {
+	server.recordCheck(ctx, checkResultSpec.Code == http.StatusOK)
+	if !checkManySpec.Debug {
+		return CheckResult{
+			CheckResultSpec: checkResultSpec,
+		}
+	}
+
+	checkResultSpec.ProcessingTime = time.Since(start).Milliseconds()
+	debug := &CheckDebugSpec{
+		Warrants:       make([]WarrantMatchSpec, len(checkManySpec.Warrants)),
+		Datastore:      server.repository(ctx).Datastore(),
+		DecisionSource: decisionSource,
+	}
+
+	for i, wnt := range checkManySpec.Warrants {
+		debug.Warrants[i].Key = NewWarrantKey(wnt).String()
+		if i < len(matches) {
+			debug.Warrants[i].Match = matches[i]
+		}
+	}
+
+	lastSynced, err := server.repository(ctx).LastSynced()
+	if err != nil {
+		log.Println(errors.Wrap(err, "error getting last synced time"))
+	} else if !lastSynced.IsZero() {
+		debug.LastSyncedAt = &lastSynced
+		debug.CacheAge = time.Since(lastSynced).Milliseconds()
+	}
+
+	return CheckResult{
+		CheckResultSpec: checkResultSpec,
+		Debug:           debug,
+	}
+}
+
+// checkScope returns an error if any of the warrants are on an object type the
+// agent does not sync.
+func (server *Server) checkScope(warrants []check.CheckWarrantSpec) error {
+	for _, wnt := range warrants {
+		if !server.config.ObjectTypes.Includes(wnt.ObjectType) {
+			return NewObjectTypeOutOfScope(wnt.ObjectType)
+		}
+	}
+
+	return nil
+}
+
+// shouldCheckUpstream reports whether a check should be forwarded upstream
+// because the repository is not ready or did not authorize it.
+func (server *Server) shouldCheckUpstream(ctx context.Context, localResult *check.CheckResultSpec) bool {
+	if server.upstream(ctx) == nil {
+		return false
+	}
+
+	return localResult == nil || localResult.Code != http.StatusOK
+}
+
+// getMatches reports whether each warrant is granted directly, on every
+// object of its type or through usersets nested up to MaxUsersetDepth deep.
+func (server *Server) getMatches(ctx context.Context, warrants []check.CheckWarrantSpec) ([]bool, error) {
+	matches := make([]bool, len(warrants))
+	visited := make([]map[string]bool, len(warrants))
+	targets := make([]usersetTarget, 0, len(warrants))
+	for i, wnt := range warrants {
+		key := NewWarrantKey(wnt)
+		visited[i] = map[string]bool{key.ObjectRelation(): true}
+		targets = append(targets, usersetTarget{owner: i, key: key})
+	}
+
+	outOfScope := make(map[int]string)
+	unresolvable := make(map[int]string)
+	for depth := 0; len(targets) > 0; depth++ {
+		keys := make([]WarrantKey, 0, len(targets)*2)
+		contexts := make([]warrant.PolicyContext, 0, len(targets)*2)
+		for _, target := range targets {
+			keys = append(keys, target.key, target.key.WithWildcardObject())
+			contexts = append(contexts, warrants[target.owner].Context, warrants[target.owner].Context)
+		}
+
+		found, err := server.lookup(ctx, keys, contexts)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, target := range targets {
+			matches[target.owner] = matches[target.owner] || found[k*2] || found[k*2+1]
+		}
+
+		unmatched := make([]usersetTarget, 0)
+		for _, target := range targets {
+			if !matches[target.owner] {
+				unmatched = append(unmatched, target)
+			}
+		}
+
+		if len(unmatched) == 0 {
+			break
+		}
+
+		if depth == MaxUsersetDepth {
+			for _, target := range unmatched {
+				unresolvable[target.owner] = target.key.ObjectRelation()
+			}
+			break
+		}
+
+		objectRelations := make([]string, 0, len(unmatched)*2)
+		for _, target := range unmatched {
+			objectRelations = append(objectRelations, target.key.ObjectRelation(), target.key.WithWildcardObject().ObjectRelation())
+		}
+
+		usersets, err := server.repository(ctx).GetUsersets(objectRelations)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip usersets already visited for the warrant so that cycles end
+		targets = make([]usersetTarget, 0)
+		for k, target := range unmatched {
+			for _, userset := range append(usersets[k*2], usersets[k*2+1]...) {
+				if !server.config.ObjectTypes.Includes(userset.ObjectType) {
+					outOfScope[target.owner] = userset.ObjectType
+					continue
+				}
+
+				key := WarrantKey{
+					ObjectType: userset.ObjectType,
+					ObjectId:   userset.ObjectId,
+					Relation:   userset.Relation,
+					Subject:    target.key.Subject,
+				}
+				if userset.ObjectId == warrant.Wildcard {
+					unresolvable[target.owner] = key.ObjectRelation()
+					continue
+				}
+
+				if visited[target.owner][key.ObjectRelation()] {
+					continue
+				}
+
+				visited[target.owner][key.ObjectRelation()] = true
+				targets = append(targets, usersetTarget{owner: target.owner, key: key})
+			}
+		}
+	}
+
+	for i := range warrants {
+		if matches[i] {
+			continue
+		}
+
+		if objectType, ok := outOfScope[i]; ok {
+			return nil, NewObjectTypeOutOfScope(objectType)
+		}
+
+		if userset, ok := unresolvable[i]; ok {
+			return nil, NewUsersetNotResolvable(userset)
+		}
+	}
+
+	return matches, nil
+}
+
+// usersetTarget is a warrant looked up while resolving the usersets of the
+// warrant at index owner of a check.
+type usersetTarget struct {
+	owner int
+	key   WarrantKey
+}
+
+// lookup reports whether each key is in the repository, either without a
+// policy or with a policy that holds for the corresponding context.
+func (server *Server) lookup(ctx context.Context, keys []WarrantKey, contexts []warrant.PolicyContext) ([]bool, error) {
+	found, err := server.repository(ctx).GetMany(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]int, 0)
+	missingKeys := make([]WarrantKey, 0)
+	for i, key := range keys {
+		if !found[i] {
+			missing = append(missing, i)
+			missingKeys = append(missingKeys, key)
+		}
+	}
+
+	if len(missingKeys) == 0 {
+		return found, nil
+	}
+
+	policies, err := server.repository(ctx).GetPolicies(missingKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range missing {
+		for _, policy := range policies[j] {
+			key := keys[i]
+			key.Policy = policy
+			if evalPolicy(key, contexts[i]) {
+				found[i] = true
+				break
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// evalPolicy evaluates a warrant's policy the way the Warrant API does.
+func evalPolicy(key WarrantKey, policyContext warrant.PolicyContext) bool {
+	policyContextWithWarrant := make(warrant.PolicyContext)
+	for k, v := range policyContext {
+		policyContextWithWarrant[k] = v
+	}
+	policyContextWithWarrant["warrant"] = key.Spec()
+
+	match, err := key.Policy.Eval(policyContextWithWarrant)
+	if err != nil {
+		log.Println(errors.Wrapf(err, "error evaluating policy of warrant %s", key))
+		return false
+	}
+
+	return match
+}
+
+// validateCheckManySpec checks the parts of a check that are not covered by
+// its validation tags.
+func validateCheckManySpec(checkManySpec check.CheckManySpec) error {
+	if len(checkManySpec.Warrants) == 0 {
+		return service.NewMissingRequiredParameterError("warrants")
+	}
+
+	if len(checkManySpec.Warrants) > MaxCheckWarrants {
+		return service.NewInvalidParameterError("warrants", fmt.Sprintf("must contain at most %d warrants", MaxCheckWarrants))
+	}
+
+	for _, wnt := range checkManySpec.Warrants {
+		if wnt.ObjectType == "" {
+			return service.NewMissingRequiredParameterError("objectType")
+		}
+
+		if wnt.ObjectId == "" {
+			return service.NewMissingRequiredParameterError("objectId")
+		}
+
+		if wnt.Relation == "" {
+			return service.NewMissingRequiredParameterError("relation")
+		}
+
+		if wnt.Subject == nil || wnt.Subject.ObjectType == "" || wnt.Subject.ObjectId == "" {
+			return service.NewMissingRequiredParameterError("subject")
+		}
+	}
+
+	switch checkManySpec.Op {
+	case OpAnyOf, OpAllOf:
+		return nil
+	case "":
+		if len(checkManySpec.Warrants) > 1 {
+			return service.NewInvalidParameterError("op", "must include operator when including multiple warrants")
+		}
+
+		return nil
+	default:
+		return service.NewInvalidParameterError("op", "must be one of anyOf or allOf")
+	}
+}
+
+// evaluateCheckManySpec returns the result of a check given whether or not
+// each of its warrants matched.
+func evaluateCheckManySpec(checkManySpec check.CheckManySpec, matches []bool) check.CheckResultSpec {
+	if checkManySpec.Op == OpAllOf {
+		for _, match := range matches {
+			if !match {
+				return newCheckResult(false)
+			}
+		}
+
+		return newCheckResult(true)
+	}
+
+	for _, match := range matches {
+		if match {
+			return newCheckResult(true)
+		}
+	}
+
+	return newCheckResult(false)
+}
+
+func newCheckResult(authorized bool) check.CheckResultSpec {
+	if authorized {
+		return check.CheckResultSpec{
+			Code:   http.StatusOK,
+			Result: ResultAuthorized,
+		}
+	}
+
+	return check.CheckResultSpec{
+		Code:   http.StatusForbidden,
+		Result: ResultNotAuthorized,
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
+func TestEvalPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  warrant.Policy
+		context warrant.PolicyContext
+		match   bool
+	}{
+		{
+			name:    "equality",
+			policy:  `tenant == "acme"`,
+			context: warrant.PolicyContext{"tenant": "acme"},
+			match:   true,
+		},
+		{
+			name:    "inequality",
+			policy:  `tenant == "acme"`,
+			context: warrant.PolicyContext{"tenant": "initech"},
+			match:   false,
+		},
+		{
+			name:    "numeric comparison",
+			policy:  `transaction.amount < 1000`,
+			context: warrant.PolicyContext{"transaction": map[string]interface{}{"amount": 500}},
+			match:   true,
+		},
+		{
+			name:    "numeric comparison of json number",
+			policy:  `transaction.amount < 1000`,
+			context: warrant.PolicyContext{"transaction": map[string]interface{}{"amount": float64(1500)}},
+			match:   false,
+		},
+		{
+			name:    "membership",
+			policy:  `clientIp in ["192.168.0.1", "192.168.0.2"]`,
+			context: warrant.PolicyContext{"clientIp": "192.168.0.2"},
+			match:   true,
+		},
+		{
+			name:    "string operator",
+			policy:  `user.email endsWith "@warrant.dev"`,
+			context: warrant.PolicyContext{"user": map[string]interface{}{"email": "john.doe@warrant.dev"}},
+			match:   true,
+		},
+		{
+			name:    "regular expression",
+			policy:  `user.email matches "^[a-z.]+@warrant\\.dev$"`,
+			context: warrant.PolicyContext{"user": map[string]interface{}{"email": "john.doe@gmail.com"}},
+			match:   false,
+		},
+		{
+			name:    "boolean operators",
+			policy:  `(tenant == "acme" || tenant == "initech") && !suspended`,
+			context: warrant.PolicyContext{"tenant": "initech", "suspended": false},
+			match:   true,
+		},
+		{
+			name:    "warrant in policy",
+			policy:  `warrant.ObjectId == documentId`,
+			context: warrant.PolicyContext{"documentId": "1"},
+			match:   true,
+		},
+		{
+			name:    "context cannot override warrant",
+			policy:  `warrant.ObjectId == "2"`,
+			context: warrant.PolicyContext{"warrant": map[string]interface{}{"objectId": "2"}},
+			match:   false,
+		},
+		{
+			name:    "missing context",
+			policy:  `tenant == "acme"`,
+			context: nil,
+			match:   false,
+		},
+		{
+			name:    "missing nested context",
+			policy:  `transaction.amount < 1000`,
+			context: warrant.PolicyContext{},
+			match:   false,
+		},
+		{
+			name:    "undefined variables",
+			policy:  `a > b`,
+			context: warrant.PolicyContext{},
+			match:   false,
+		},
+		{
+			name:    "syntax error",
+			policy:  `tenant ==`,
+			context: warrant.PolicyContext{"tenant": "acme"},
+			match:   false,
+		},
+		{
+			name:    "type error",
+			policy:  `transaction.amount < 1000`,
+			context: warrant.PolicyContext{"transaction": map[string]interface{}{"amount": "500"}},
+			match:   false,
+		},
+		{
+			name:    "non boolean result",
+			policy:  `tenant`,
+			context: warrant.PolicyContext{"tenant": "acme"},
+			match:   false,
+		},
+		{
+			// the Warrant API evaluates check policies against the warrant's
+			// spec, which has no creation time, so expiresIn never matches
+			name:    "expiresIn",
+			policy:  `expiresIn("1h")`,
+			context: warrant.PolicyContext{},
+			match:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := WarrantKey{
+				ObjectType: "document",
+				ObjectId:   "1",
+				Relation:   "viewer",
+				Subject: SubjectKey{
+					ObjectType: "user",
+					ObjectId:   "1",
+				},
+				Policy: test.policy,
+			}
+
+			match := evalPolicy(key, test.context)
+			if match != test.match {
+				t.Errorf("expected %s to evaluate to %t, got %t", test.policy, test.match, match)
+			}
+		})
+	}
+}
+
+func TestCheckManyOutOfScopeUserset(t *testing.T) {
+	objectTypes, err := NewObjectTypeFilter([]string{"document"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := SubjectKey{ObjectType: "group", ObjectId: "eng", Relation: "member"}
+	repo := NewMemoryRepository()
+	err = repo.Update(WarrantSet{
+		WarrantKey{ObjectType: "document", ObjectId: "1", Relation: "viewer", Subject: group}:                                         1,
+		WarrantKey{ObjectType: "document", ObjectId: "2", Relation: "viewer", Subject: group}:                                         1,
+		WarrantKey{ObjectType: "document", ObjectId: "2", Relation: "viewer", Subject: SubjectKey{ObjectType: "user", ObjectId: "1"}}: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		ObjectTypes: objectTypes,
+		Repository:  repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkDocument := func(objectId string) (CheckResult, error) {
+		result, _, err := server.checkMany(context.Background(), check.CheckManySpec{
+			Warrants: []check.CheckWarrantSpec{
+				{
+					ObjectType: "document",
+					ObjectId:   objectId,
+					Relation:   "viewer",
+					Subject:    &warrant.SubjectSpec{ObjectType: "user", ObjectId: "1"},
+				},
+			},
+		})
+		return result, err
+	}
+
+	// granted directly, so the out of scope userset doesn't matter
+	result, err := checkDocument("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != http.StatusOK {
+		t.Errorf("expected check to be authorized, got %s", result.Result)
+	}
+
+	// could only be granted through the out of scope userset
+	_, err = checkDocument("1")
+	var outOfScopeErr *ObjectTypeOutOfScope
+	if !errors.As(err, &outOfScopeErr) {
+		t.Errorf("expected check to be out of scope, got %v", err)
+	}
+}
+
+func TestBatchCheckManyBypassesLocalCache(t *testing.T) {
+	memory := NewMemoryRepository()
+	counting := &countingRepository{IRepository: memory}
+	repo, err := NewCachedRepository(CachedRepositoryConfig{
+		Size:       10,
+		Repository: counting,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.SetReady(true)
+
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		Repository:  repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkDocument := func(objectId string) check.CheckManySpec {
+		return check.CheckManySpec{
+			Warrants: []check.CheckWarrantSpec{
+				{
+					ObjectType: "document",
+					ObjectId:   objectId,
+					Relation:   "viewer",
+					Subject:    &warrant.SubjectSpec{ObjectType: "user", ObjectId: "1"},
+				},
+			},
+		}
+	}
+
+	// cache a denial for document 1, then grant it behind the cache's back
+	result, _, err := server.checkMany(context.Background(), checkDocument("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code == http.StatusOK {
+		t.Fatal("expected check to be denied")
+	}
+	err = memory.Update(WarrantSet{
+		WarrantKey{ObjectType: "document", ObjectId: "1", Relation: "viewer", Subject: SubjectKey{ObjectType: "user", ObjectId: "1"}}: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting.warrantLookups = 0
+	results, err := server.batchCheckMany(context.Background(), []check.CheckManySpec{checkDocument("1"), checkDocument("2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Code != http.StatusOK {
+		t.Errorf("expected batch to see the grant behind the cache, got %s", results[0].Result)
+	}
+	if results[1].Code == http.StatusOK {
+		t.Errorf("expected document 2 to be denied, got %s", results[1].Result)
+	}
+	if counting.warrantLookups != 1 {
+		t.Errorf("expected the warrants of all checks to be looked up at once, got %d lookups", counting.warrantLookups)
+	}
+}
+
+func TestCheckManyNestedUsersets(t *testing.T) {
+	user := SubjectKey{ObjectType: "user", ObjectId: "1"}
+	member := func(objectId string) SubjectKey {
+		return SubjectKey{ObjectType: "group", ObjectId: objectId, Relation: "member"}
+	}
+	warrants := WarrantSet{
+		// document 1 through platform, a member group of eng
+		WarrantKey{ObjectType: "document", ObjectId: "1", Relation: "viewer", Subject: member("eng")}:     1,
+		WarrantKey{ObjectType: "group", ObjectId: "eng", Relation: "member", Subject: member("platform")}: 1,
+		WarrantKey{ObjectType: "group", ObjectId: "platform", Relation: "member", Subject: user}:          1,
+		// document 2 through a cycle the user isn't part of
+		WarrantKey{ObjectType: "document", ObjectId: "2", Relation: "viewer", Subject: member("a")}: 1,
+		WarrantKey{ObjectType: "group", ObjectId: "a", Relation: "member", Subject: member("b")}:    1,
+		WarrantKey{ObjectType: "group", ObjectId: "b", Relation: "member", Subject: member("a")}:    1,
+		// document 3 through members of every group
+		WarrantKey{ObjectType: "document", ObjectId: "3", Relation: "viewer", Subject: member(warrant.Wildcard)}: 1,
+	}
+
+	// document 4 through a chain of groups one level deeper than resolved
+	warrants[WarrantKey{ObjectType: "document", ObjectId: "4", Relation: "viewer", Subject: member("0")}] = 1
+	for i := 0; i < MaxUsersetDepth; i++ {
+		warrants[WarrantKey{ObjectType: "group", ObjectId: strconv.Itoa(i), Relation: "member", Subject: member(strconv.Itoa(i + 1))}] = 1
+	}
+	warrants[WarrantKey{ObjectType: "group", ObjectId: strconv.Itoa(MaxUsersetDepth), Relation: "member", Subject: user}] = 1
+
+	repo := NewMemoryRepository()
+	err := repo.Update(warrants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.SetReady(true)
+
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		Repository:  repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkDocument := func(objectId string) (CheckResult, error) {
+		result, _, err := server.checkMany(context.Background(), check.CheckManySpec{
+			Warrants: []check.CheckWarrantSpec{
+				{
+					ObjectType: "document",
+					ObjectId:   objectId,
+					Relation:   "viewer",
+					Subject:    &warrant.SubjectSpec{ObjectType: "user", ObjectId: "1"},
+				},
+			},
+		})
+		return result, err
+	}
+
+	result, err := checkDocument("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != http.StatusOK {
+		t.Errorf("expected check through nested groups to be authorized, got %s", result.Result)
+	}
+
+	result, err = checkDocument("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code == http.StatusOK {
+		t.Errorf("expected check through a cycle to be denied, got %s", result.Result)
+	}
+
+	for _, objectId := range []string{"3", "4"} {
+		_, err = checkDocument(objectId)
+		var notResolvableErr *UsersetNotResolvable
+		if !errors.As(err, &notResolvableErr) {
+			t.Errorf("expected check on document %s not to be resolvable, got %v", objectId, err)
+		}
+	}
+}
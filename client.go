@@ -16,12 +16,19 @@ package edge
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -34,6 +41,8 @@ const (
 	DefaultApiEndpoint       = "https://api.warrant.dev"
 	DefaultStreamingEndpoint = "https://stream.warrant.dev/v1"
 	DefaultPollingFrequency  = 10
+	LoadBatchSize            = 1000
+	LoadProgressInterval     = 100000
 
 	EventTypeSetWarrants    = "set_warrants"
 	EventTypeDeleteWarrants = "del_warrants"
@@ -42,26 +51,49 @@ const (
 
 	UpdateStrategyPolling   = "POLLING"
 	UpdateStrategyStreaming = "STREAMING"
+	UpdateStrategyFile      = "FILE"
+
+	// SignatureHeader carries the Ed25519ph signature of a response over the
+	// time in SignedAtHeader and its body.
+	SignatureHeader = "Warrant-Signature"
+	SignedAtHeader  = "Warrant-Signed-At"
+
+	// SignatureMaxAge is how far the time a response or event was signed at
+	// may be from the agent's clock before it's rejected as stale.
+	SignatureMaxAge = 5 * time.Minute
 )
 
 var (
 	ErrInvalidUpdateStrategy   = errors.New("invalid update strategy")
 	ErrInvalidPollingFrequency = errors.New("invalid polling frequency (must be >= 10)")
 	ErrMissingApiKey           = errors.New("missing API key")
+	ErrMissingUpdateDirectory  = errors.New("missing update directory")
+	ErrMissingPublicKey        = errors.New("missing public key")
+	ErrStaleSignature          = errors.New("stale signature")
+	ErrReplayedSignature       = errors.New("replayed signature")
 )
 
+// ClientConfig configures a Client. If PublicKey is set, every update file,
+// response and event the client syncs must be signed with its private key.
 type ClientConfig struct {
 	ApiKey            string
 	ApiEndpoint       string
 	UpdateStrategy    string
 	StreamingEndpoint string
 	PollingFrequency  int
+	UpdateDirectory   string
+	PublicKey         ed25519.PublicKey
+	ObjectTypes       *ObjectTypeFilter
 	Repository        IRepository
 }
 
 type Client struct {
 	config          ClientConfig
 	streamingClient *sse.Client
+	lock            sync.RWMutex
+	expandWindow    replayWindow
+	eventWindow     replayWindow
+	rejected        atomic.Uint64
 }
 
 func NewClient(conf ClientConfig) (*Client, error) {
@@ -70,10 +102,13 @@ func NewClient(conf ClientConfig) (*Client, error) {
 		StreamingEndpoint: DefaultStreamingEndpoint,
 		UpdateStrategy:    UpdateStrategyPolling,
 		PollingFrequency:  DefaultPollingFrequency,
+		PublicKey:         conf.PublicKey,
+		ObjectTypes:       conf.ObjectTypes,
 		Repository:        conf.Repository,
 	}
 
-	if conf.ApiKey == "" {
+	// file updates are made without the Warrant API
+	if conf.ApiKey == "" && !strings.EqualFold(conf.UpdateStrategy, UpdateStrategyFile) {
 		return nil, ErrMissingApiKey
 	} else {
 		config.ApiKey = conf.ApiKey
@@ -100,8 +135,6 @@ func NewClient(conf ClientConfig) (*Client, error) {
 
 	if strings.EqualFold(config.UpdateStrategy, UpdateStrategyStreaming) {
 		streamingClient := sse.NewClient(fmt.Sprintf("%s/events", config.StreamingEndpoint))
-		streamingClient.Headers["Authorization"] = fmt.Sprintf("ApiKey %s", config.ApiKey)
-		streamingClient.ReconnectStrategy = backoff.WithMaxTries(backoff.NewExponentialBackOff(), 10)
 		streamingClient.ReconnectNotify = reconnectNotify
 
 		return &Client{
@@ -112,27 +145,170 @@ func NewClient(conf ClientConfig) (*Client, error) {
 		return &Client{
 			config: config,
 		}, nil
+	} else if strings.EqualFold(config.UpdateStrategy, UpdateStrategyFile) {
+		if conf.UpdateDirectory == "" {
+			return nil, ErrMissingUpdateDirectory
+		}
+
+		if conf.PublicKey == nil {
+			return nil, ErrMissingPublicKey
+		}
+
+		if _, ok := conf.Repository.(IDeltaRepository); !ok {
+			return nil, ErrDeltasNotSupported
+		}
+
+		config.UpdateDirectory = conf.UpdateDirectory
+		return &Client{
+			config: config,
+		}, nil
 	} else {
 		return nil, ErrInvalidUpdateStrategy
 	}
 }
 
+// SetApiKey rotates the API key the client syncs warrants with from its next
+// request or connection.
+func (client *Client) SetApiKey(apiKey string) error {
+	if apiKey == "" && !strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyFile) {
+		return ErrMissingApiKey
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.config.ApiKey = apiKey
+	return nil
+}
+
+// SetPollingFrequency changes how often a polling client fetches warrants, or a
+// client updated from files checks for new ones, starting after its next poll. A frequency of 0 restores the default.
+func (client *Client) SetPollingFrequency(pollingFrequency int) error {
+	if pollingFrequency == 0 {
+		pollingFrequency = DefaultPollingFrequency
+	} else if pollingFrequency < 10 {
+		return ErrInvalidPollingFrequency
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.config.PollingFrequency = pollingFrequency
+	return nil
+}
+
+func (client *Client) apiKey() string {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.config.ApiKey
+}
+
+func (client *Client) pollingFrequency() int {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.config.PollingFrequency
+}
+
+// Rejected returns the number of updates the client has rejected since it
+// started.
+func (client *Client) Rejected() uint64 {
+	return client.rejected.Load()
+}
+
+// reject counts and logs an update that was rejected.
+func (client *Client) reject(err error) {
+	client.rejected.Add(1)
+	log.Println(err)
+}
+
+// acceptSignedAt checks that a signature is recent and hasn't been replayed
+// within window, returning the time it was made at.
+func acceptSignedAt(window *replayWindow, value string, signed []byte) (time.Time, error) {
+	signedAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(ErrStaleSignature, "invalid signing time %q", value)
+	}
+
+	now := time.Now()
+	if signedAt.Before(now.Add(-SignatureMaxAge)) || signedAt.After(now.Add(SignatureMaxAge)) {
+		return signedAt, errors.Wrapf(ErrStaleSignature, "signed at %s", value)
+	}
+
+	return signedAt, window.accept(signedAt, sha256.Sum256(signed))
+}
+
+// replayWindow holds the latest signing time accepted for one kind of update
+// and the digests of the updates signed at that time.
+type replayWindow struct {
+	last    time.Time
+	digests map[[sha256.Size]byte]struct{}
+	lock    sync.Mutex
+}
+
+func (window *replayWindow) accept(signedAt time.Time, digest [sha256.Size]byte) error {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	if signedAt.Before(window.last) {
+		return errors.Wrapf(ErrStaleSignature, "signed at %s, before %s", signedAt.Format(time.RFC3339Nano), window.last.Format(time.RFC3339Nano))
+	}
+
+	if signedAt.After(window.last) {
+		window.last = signedAt
+		window.digests = make(map[[sha256.Size]byte]struct{})
+	}
+
+	if _, ok := window.digests[digest]; ok {
+		return errors.Wrapf(ErrReplayedSignature, "signed at %s", signedAt.Format(time.RFC3339Nano))
+	}
+
+	window.digests[digest] = struct{}{}
+	return nil
+}
+
+// covers reports whether signedAt is no later than the last time accepted.
+func (window *replayWindow) covers(signedAt time.Time) bool {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	return !signedAt.After(window.last)
+}
+
 func (client *Client) Run() error {
-	err := client.initialize()
+	return client.RunWithContext(context.Background())
+}
+
+// RunWithContext keeps the repository up to date until the given context is
+// cancelled, after which nothing more is written to it.
+func (client *Client) RunWithContext(ctx context.Context) error {
+	resume, err := client.canResume()
 	if err != nil {
 		return errors.Wrap(err, "error trying to initialize edge agent")
 	}
 
+	if resume {
+		log.Println("Warrants were synced recently. Resuming without reloading them.")
+		client.config.Repository.SetReady(true)
+	} else {
+		err = client.initialize(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error trying to initialize edge agent")
+		}
+	}
+
 	if strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyStreaming) {
-		err = client.connect()
+		err = client.connect(ctx)
 		if err != nil {
 			return errors.Wrap(err, "error streaming warrant updates")
 		}
 	} else if strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyPolling) {
-		err = client.poll()
+		err = client.poll(ctx)
 		if err != nil {
 			return errors.Wrap(err, "error polling warrant updates")
 		}
+	} else if strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyFile) {
+		client.watch(ctx)
 	} else {
 		return ErrInvalidUpdateStrategy
 	}
@@ -140,101 +316,286 @@ func (client *Client) Run() error {
 	return nil
 }
 
-func (client *Client) initialize() error {
-	client.config.Repository.SetReady(false)
-	err := client.config.Repository.Clear()
+// canResume reports whether a polling client can skip the initial load because
+// another agent synced the repository within the last polling interval.
+func (client *Client) canResume() (bool, error) {
+	if !strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyPolling) {
+		return false, nil
+	}
+
+	lastSynced, err := client.config.Repository.LastSynced()
 	if err != nil {
-		return errors.Wrap(err, "error clearing cache")
+		return false, errors.Wrap(err, "error getting last synced time")
 	}
 
-	warrants, err := client.getWarrants()
+	return !lastSynced.IsZero() && time.Since(lastSynced) < time.Second*time.Duration(client.pollingFrequency()), nil
+}
+
+func (client *Client) initialize(ctx context.Context) error {
+	// keep serving the warrants already synced, if any, such as from a
+	// snapshot, while the new ones are staged or applied
+	lastSynced, err := client.config.Repository.LastSynced()
 	if err != nil {
-		return errors.Wrap(err, "error getting warrants")
+		return errors.Wrap(err, "error getting last synced time")
 	}
 
-	for warrant, count := range warrants {
-		err := client.config.Repository.Set(warrant, count)
-		if err != nil {
-			return errors.Wrapf(err, "error setting warrant %s in cache", warrant)
-		}
+	if lastSynced.IsZero() {
+		client.config.Repository.SetReady(false)
 	}
 
+	if strings.EqualFold(client.config.UpdateStrategy, UpdateStrategyFile) {
+		return client.initializeFromFiles()
+	}
+
+	start := time.Now()
+	staged, err := client.load(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	log.Printf("Loaded %d warrants in %s", staged, time.Since(start).Round(time.Millisecond))
+
 	client.config.Repository.SetReady(true)
 	return nil
 }
 
-func (client *Client) connect() error {
-	client.streamingClient.OnDisconnect(client.restart)
-	err := client.streamingClient.Subscribe(client.config.ApiKey, client.processEvent)
+// load stages every warrant from the Warrant API and commits them in place of
+// the repository's warrants, unless the context is cancelled first.
+func (client *Client) load(ctx context.Context) (int, error) {
+	loader, err := client.config.Repository.Load()
+	if err != nil {
+		return 0, errors.Wrap(err, "error staging warrants")
+	}
+
+	staged := 0
+	err = client.readWarrants(ctx, func(warrants WarrantSet) error {
+		err := loader.Add(warrants)
+		if err != nil {
+			return errors.Wrap(err, "error staging warrants")
+		}
+
+		if (staged+len(warrants))/LoadProgressInterval > staged/LoadProgressInterval {
+			log.Printf("Loaded %d warrants", staged+len(warrants))
+		}
+		staged += len(warrants)
+		return nil
+	})
+	if err != nil {
+		if discardErr := loader.Discard(); discardErr != nil {
+			log.Println(errors.Wrap(discardErr, "error discarding staged warrants"))
+		}
+
+		return 0, errors.Wrap(err, "error getting warrants")
+	}
+
+	if ctx.Err() != nil {
+		return 0, loader.Discard()
+	}
+
+	err = loader.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "error committing staged warrants")
+	}
+
+	err = client.config.Repository.SetLastSynced(time.Now())
+	if err != nil {
+		return 0, errors.Wrap(err, "error setting last synced time")
+	}
+
+	return staged, nil
+}
+
+func (client *Client) connect(ctx context.Context) error {
+	client.streamingClient.Headers["Authorization"] = fmt.Sprintf("ApiKey %s", client.apiKey())
+	client.streamingClient.ReconnectStrategy = backoff.WithContext(backoff.WithMaxTries(backoff.NewExponentialBackOff(), 10), ctx)
+	client.streamingClient.OnDisconnect(func(c *sse.Client) {
+		client.restart(ctx, c)
+	})
+	err := client.streamingClient.SubscribeWithContext(ctx, client.apiKey(), func(event *sse.Event) {
+		client.processEvent(ctx, event)
+	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+
 		return err
 	}
 
 	return nil
 }
 
-func (client *Client) poll() error {
+func (client *Client) poll(ctx context.Context) error {
 	for {
-		time.Sleep(time.Second * time.Duration(client.config.PollingFrequency))
-		warrants, err := client.getWarrants()
-		if err != nil {
-			return errors.Wrap(err, "error getting warrants")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second * time.Duration(client.pollingFrequency())):
 		}
 
-		err = client.config.Repository.Update(warrants)
+		// loads only commit while the leader's lease is held
+		_, err := client.load(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			return errors.Wrap(err, "error updating warrants")
+			return err
 		}
 	}
 }
 
-func (client *Client) getWarrants() (WarrantSet, error) {
-	resp, err := client.makeRequest("GET", fmt.Sprintf("%s/expand", ApiVersion), nil)
+// GetWarrants downloads every warrant in scope from the Warrant API.
+func (client *Client) GetWarrants() (WarrantSet, error) {
+	return client.getWarrants(context.Background())
+}
+
+func (client *Client) getWarrants(ctx context.Context) (WarrantSet, error) {
+	warrants := make(WarrantSet)
+	err := client.readWarrants(ctx, func(batch WarrantSet) error {
+		for key, count := range batch {
+			warrants[key] += count
+		}
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	return warrants, nil
+}
+
+// readWarrants streams every warrant in scope from the Warrant API to fn in
+// batches of up to LoadBatchSize.
+func (client *Client) readWarrants(ctx context.Context, fn func(warrants WarrantSet) error) error {
+	resp, err := client.makeRequest(ctx, "GET", fmt.Sprintf("%s/expand", ApiVersion), nil)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
 	respStatus := resp.StatusCode
 	if respStatus < 200 || respStatus >= 400 {
 		msg, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, errors.Wrap(err, "error reading response from server")
+			return errors.Wrap(err, "error reading response from server")
 		}
 
-		return nil, errors.New(fmt.Sprintf("received HTTP %d: %s", respStatus, string(msg)))
+		return errors.New(fmt.Sprintf("received HTTP %d: %s", respStatus, string(msg)))
 	}
 
-	warrants := make(WarrantSet)
-	decoder := json.NewDecoder(resp.Body)
+	// the signature is verified once the whole response has been digested, so
+	// fn must only stage warrants
+	var body io.Reader = resp.Body
+	var digest hash.Hash
+	signedAt := resp.Header.Get(SignedAtHeader)
+	if client.config.PublicKey != nil {
+		digest = sha512.New()
+		digest.Write([]byte(signedAt + "\n"))
+		body = io.TeeReader(resp.Body, digest)
+	}
+
+	batch := make(WarrantSet)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := fn(client.config.ObjectTypes.Filter(batch))
+		batch = make(WarrantSet)
+		return err
+	}
+
+	// the response is a sequence of objects keyed by warrant, decoded a
+	// warrant at a time so that no object is held in memory whole
+	decoder := json.NewDecoder(body)
 	for decoder.More() {
-		var chunk WarrantSet
-		err := decoder.Decode(&chunk)
+		token, err := decoder.Token()
 		if err != nil {
-			return nil, errors.Wrap(err, "error reading response from server")
+			return errors.Wrap(err, "error reading response from server")
+		}
+		if token != json.Delim('{') {
+			return errors.Errorf("error reading response from server: unexpected %v", token)
 		}
 
-		for w := range chunk {
-			warrants.Add(w)
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return errors.Wrap(err, "error reading response from server")
+			}
+
+			key, err := ParseWarrantKey(token.(string))
+			if err != nil {
+				return errors.Wrap(err, "error reading response from server")
+			}
+
+			var value json.RawMessage
+			err = decoder.Decode(&value)
+			if err != nil {
+				return errors.Wrap(err, "error reading response from server")
+			}
+
+			batch.Add(key)
+			if len(batch) == LoadBatchSize {
+				err := flush()
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err = decoder.Token()
+		if err != nil {
+			return errors.Wrap(err, "error reading response from server")
 		}
 	}
 
-	return warrants, nil
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	if digest != nil {
+		// digest anything the decoder hasn't read
+		_, err = io.Copy(io.Discard, body)
+		if err != nil {
+			return errors.Wrap(err, "error reading response from server")
+		}
+
+		sum := digest.Sum(nil)
+		err = VerifyDigestSignature(client.config.PublicKey, sum, resp.Header.Get(SignatureHeader))
+		if err == nil {
+			_, err = acceptSignedAt(&client.expandWindow, signedAt, sum)
+		}
+		if err != nil {
+			err = errors.Wrap(err, "rejected warrants from the Warrant API")
+			client.reject(err)
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (client *Client) makeRequest(method string, requestUri string, payload interface{}) (*http.Response, error) {
+func (client *Client) makeRequest(ctx context.Context, method string, requestUri string, payload interface{}) (*http.Response, error) {
 	postBody, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
 	requestBody := bytes.NewBuffer(postBody)
-	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", client.config.ApiEndpoint, requestUri), requestBody)
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/%s", client.config.ApiEndpoint, requestUri), requestBody)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating request object")
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", client.config.ApiKey))
+	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", client.apiKey()))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error making request to server")
@@ -243,32 +604,97 @@ func (client *Client) makeRequest(method string, requestUri string, payload inte
 	return resp, nil
 }
 
-func (client *Client) processEvent(event *sse.Event) {
+// signedEvent is the data of a signed event. The signature covers the event
+// type, SignedAt and the payload, separated by newlines.
+type signedEvent struct {
+	Payload   json.RawMessage `json:"payload"`
+	SignedAt  string          `json:"signedAt"`
+	Signature string          `json:"signature"`
+}
+
+// verifyEvent returns the payload of a signed event and when it was signed.
+func (client *Client) verifyEvent(event *sse.Event) ([]byte, time.Time, error) {
+	var signed signedEvent
+	err := json.Unmarshal(event.Data, &signed)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(ErrInvalidSignature, "invalid signed event data %s", event.Data)
+	}
+
+	message := bytes.Join([][]byte{event.Event, []byte(signed.SignedAt), signed.Payload}, []byte("\n"))
+	err = VerifySignature(client.config.PublicKey, message, signed.Signature)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	signedAt, err := acceptSignedAt(&client.eventWindow, signed.SignedAt, message)
+	if err != nil {
+		return nil, signedAt, err
+	}
+
+	return signed.Payload, signedAt, nil
+}
+
+func (client *Client) processEvent(ctx context.Context, event *sse.Event) {
+	// drop events still being delivered after leadership was lost
+	if ctx.Err() != nil {
+		return
+	}
+
+	data := event.Data
+	if client.config.PublicKey != nil {
+		var signedAt time.Time
+		var err error
+		data, signedAt, err = client.verifyEvent(event)
+		if err != nil {
+			client.reject(errors.Wrapf(err, "rejected event %s", event.Event))
+
+			// a stale event may only have been delayed, so reload unless
+			// that's happened since
+			if errors.Is(err, ErrStaleSignature) && !signedAt.IsZero() && !client.expandWindow.covers(signedAt) {
+				err = client.initialize(ctx)
+				if err != nil {
+					log.Println(errors.Wrap(err, "error reloading warrants"))
+				}
+			}
+			return
+		}
+	}
+
 	var err error
 	switch string(event.Event) {
 	case EventTypeSetWarrants:
-		err = client.processSetWarrants(event)
+		err = client.processSetWarrants(data)
 	case EventTypeDeleteWarrants:
-		err = client.processDeleteWarrants(event)
+		err = client.processDeleteWarrants(data)
 	case EventTypeResetWarrants:
-		err = client.initialize()
+		err = client.initialize(ctx)
 	case EventTypeShutdown:
 		log.Fatal("Shutdown event received. Shutting down.")
 	}
 
+	if err == nil {
+		err = client.config.Repository.SetLastSynced(time.Now())
+	}
+
 	if err != nil {
 		log.Println(errors.Wrapf(err, "error processing event %s.", event.Event))
 	}
 }
 
-func (client *Client) processSetWarrants(event *sse.Event) error {
+func (client *Client) processSetWarrants(data []byte) error {
 	var warrants WarrantSet
-	err := json.Unmarshal(event.Data, &warrants)
+	err := json.Unmarshal(data, &warrants)
 	if err != nil {
-		return errors.Wrapf(err, "invalid event data %s", event.Data)
+		return errors.Wrapf(err, "invalid event data %s", data)
 	}
 
-	for w, count := range warrants {
+	return client.addWarrants(warrants)
+}
+
+// addWarrants increments the count of each warrant in scope by its count in
+// warrants.
+func (client *Client) addWarrants(warrants WarrantSet) error {
+	for w, count := range client.config.ObjectTypes.Filter(warrants) {
 		var i uint16 = 0
 		for ; i < count; i++ {
 			err := client.config.Repository.Incr(w)
@@ -281,14 +707,20 @@ func (client *Client) processSetWarrants(event *sse.Event) error {
 	return nil
 }
 
-func (client *Client) processDeleteWarrants(event *sse.Event) error {
+func (client *Client) processDeleteWarrants(data []byte) error {
 	var warrants WarrantSet
-	err := json.Unmarshal(event.Data, &warrants)
+	err := json.Unmarshal(data, &warrants)
 	if err != nil {
-		return errors.Wrapf(err, "invalid event data %s", event.Data)
+		return errors.Wrapf(err, "invalid event data %s", data)
 	}
 
-	for w, count := range warrants {
+	return client.removeWarrants(warrants)
+}
+
+// removeWarrants decrements the count of each warrant in scope by its count in
+// warrants.
+func (client *Client) removeWarrants(warrants WarrantSet) error {
+	for w, count := range client.config.ObjectTypes.Filter(warrants) {
 		var i uint16 = 0
 		for ; i < count; i++ {
 			err := client.config.Repository.Decr(w)
@@ -301,12 +733,16 @@ func (client *Client) processDeleteWarrants(event *sse.Event) error {
 	return nil
 }
 
-func (client *Client) restart(c *sse.Client) {
+func (client *Client) restart(ctx context.Context, c *sse.Client) {
 	log.Printf("Disconnected from %s.", client.config.StreamingEndpoint)
+	if ctx.Err() != nil {
+		return
+	}
+
 	client.config.Repository.SetReady(false)
 
 	log.Println("Attempting to reconnect...")
-	err := client.Run()
+	err := client.RunWithContext(ctx)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "error restarting client"))
 	}
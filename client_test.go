@@ -0,0 +1,379 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/r3labs/sse"
+)
+
+func TestProcessSignedEvent(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reloading the warrants leaves just the first
+	first, second := benchmarkKey(1), benchmarkKey(2)
+	body := []byte(fmt.Sprintf(`{%q: {}}`, first.String()))
+	var loads atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loads.Add(1)
+		signedAt := time.Now().UTC().Format(time.RFC3339Nano)
+		w.Header().Set(SignedAtHeader, signedAt)
+		w.Header().Set(SignatureHeader, signTestDigest(t, privateKey, []byte(signedAt), body))
+		_, _ = w.Write(body)
+	}))
+	defer api.Close()
+
+	repo := NewMemoryRepository()
+	client := &Client{config: ClientConfig{
+		ApiEndpoint: api.URL,
+		PublicKey:   publicKey,
+		Repository:  repo,
+	}}
+
+	now := time.Now()
+	accepted := signTestEvent(t, privateKey, EventTypeSetWarrants, now, WarrantSet{first: 1})
+	tests := []struct {
+		name     string
+		event    *sse.Event
+		rejected uint64
+		loads    int32
+		warrants []WarrantKey
+	}{
+		{
+			name:     "valid",
+			event:    accepted,
+			warrants: []WarrantKey{first},
+		},
+		{
+			name:     "signed at the same time as the last event",
+			event:    signTestEvent(t, privateKey, EventTypeSetWarrants, now, WarrantSet{second: 1}),
+			warrants: []WarrantKey{first, second},
+		},
+		{
+			name:     "replayed",
+			event:    accepted,
+			rejected: 1,
+			warrants: []WarrantKey{first, second},
+		},
+		{
+			name:     "signed before the last event",
+			event:    signTestEvent(t, privateKey, EventTypeDeleteWarrants, now.Add(-time.Second), WarrantSet{first: 1}),
+			rejected: 2,
+			loads:    1,
+			warrants: []WarrantKey{first},
+		},
+		{
+			name:     "signed before the warrants were reloaded",
+			event:    signTestEvent(t, privateKey, EventTypeSetWarrants, now.Add(-2*time.Second), WarrantSet{second: 1}),
+			rejected: 3,
+			loads:    1,
+			warrants: []WarrantKey{first},
+		},
+		{
+			name:     "signed too long ago",
+			event:    signTestEvent(t, privateKey, EventTypeSetWarrants, now.Add(-2*SignatureMaxAge), WarrantSet{second: 1}),
+			rejected: 4,
+			loads:    1,
+			warrants: []WarrantKey{first},
+		},
+		{
+			name: "replayed as another event type",
+			event: &sse.Event{
+				Event: []byte(EventTypeDeleteWarrants),
+				Data:  signTestEvent(t, privateKey, EventTypeSetWarrants, time.Now().Add(time.Second), WarrantSet{first: 1}).Data,
+			},
+			rejected: 5,
+			loads:    1,
+			warrants: []WarrantKey{first},
+		},
+		{
+			name:     "signed with another key",
+			event:    signTestEvent(t, otherTestKey(t), EventTypeSetWarrants, time.Now().Add(time.Second), WarrantSet{second: 1}),
+			rejected: 6,
+			loads:    1,
+			warrants: []WarrantKey{first},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client.processEvent(context.Background(), test.event)
+			if client.Rejected() != test.rejected {
+				t.Fatalf("expected %d rejected, got %d", test.rejected, client.Rejected())
+			}
+			if loads.Load() != test.loads {
+				t.Fatalf("expected warrants to be loaded %d times, got %d", test.loads, loads.Load())
+			}
+
+			expectWarrants(t, repo, test.warrants...)
+		})
+	}
+}
+
+func TestReadSignedWarrants(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(fmt.Sprintf(`{%q: {}}`, benchmarkKey(1).String()))
+	signedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	signature := signTestDigest(t, privateKey, []byte(signedAt), body)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignedAtHeader, signedAt)
+		w.Header().Set(SignatureHeader, signature)
+		_, _ = w.Write(body)
+	}))
+	defer api.Close()
+
+	client := &Client{config: ClientConfig{
+		ApiEndpoint: api.URL,
+		PublicKey:   publicKey,
+		Repository:  NewMemoryRepository(),
+	}}
+
+	warrants, err := client.getWarrants(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !warrants.Has(benchmarkKey(1)) {
+		t.Fatalf("expected %s, got %s", benchmarkKey(1), warrants)
+	}
+
+	// the same signed response served again is a replay
+	_, err = client.getWarrants(context.Background())
+	if !errors.Is(err, ErrReplayedSignature) {
+		t.Fatalf("expected ErrReplayedSignature, got %v", err)
+	}
+	if client.Rejected() != 1 {
+		t.Fatalf("expected 1 rejected, got %d", client.Rejected())
+	}
+}
+
+func TestInitializeRejectsTamperedWarrants(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	signed := []byte(fmt.Sprintf(`{%q: {}}`, benchmarkKey(1).String()))
+	signature := signTestDigest(t, privateKey, []byte(signedAt), signed)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignedAtHeader, signedAt)
+		w.Header().Set(SignatureHeader, signature)
+		_, _ = fmt.Fprintf(w, `{%q: {}}`, benchmarkKey(2).String())
+	}))
+	defer api.Close()
+
+	repo := NewMemoryRepository()
+	err = repo.Update(WarrantSet{benchmarkKey(1): 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{config: ClientConfig{
+		ApiEndpoint: api.URL,
+		PublicKey:   publicKey,
+		Repository:  repo,
+	}}
+
+	// the tampered warrants are staged as they're read, but never committed
+	err = client.initialize(context.Background())
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+	expectWarrants(t, repo, benchmarkKey(1))
+}
+
+// loadTestWarrants is the number of warrants in the expand response streamed
+// by TestReadWarrantsMemory.
+const loadTestWarrants = 1000000
+
+// TestReadWarrantsMemory checks that a signed expand response is decoded and
+// verified as it's streamed, without holding the response in memory.
+func TestReadWarrantsMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping million-warrant load in short mode")
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the response is generated as it's written, once to sign it and again
+	// to serve it, so that it's never held in memory by the test either
+	writeBody := func(w io.Writer) (uint64, error) {
+		buf := bufio.NewWriter(w)
+		line := make([]byte, 0, 64)
+		size := uint64(0)
+		for i := 0; i < loadTestWarrants; i++ {
+			line = append(line[:0], ',')
+			if i == 0 {
+				line[0] = '{'
+			}
+			line = append(line, `"document:`...)
+			line = strconv.AppendInt(line, int64(i), 10)
+			line = append(line, "#viewer@user:"...)
+			line = strconv.AppendInt(line, int64(i%100), 10)
+			line = append(line, `": {}`...)
+			n, err := buf.Write(line)
+			if err != nil {
+				return 0, err
+			}
+			size += uint64(n)
+		}
+		_, err := buf.WriteString("}")
+		if err != nil {
+			return 0, err
+		}
+
+		return size + 1, buf.Flush()
+	}
+
+	signedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	digest := sha512.New()
+	digest.Write([]byte(signedAt + "\n"))
+	size, err := writeBody(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := privateKey.Sign(nil, digest.Sum(nil), &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignedAtHeader, signedAt)
+		w.Header().Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+		_, _ = writeBody(w)
+	}))
+	defer api.Close()
+
+	client := &Client{config: ClientConfig{
+		ApiEndpoint: api.URL,
+		PublicKey:   publicKey,
+	}}
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	var peak uint64
+	read := 0
+	err = client.readWarrants(context.Background(), func(warrants WarrantSet) error {
+		read += len(warrants)
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > baseline && stats.HeapAlloc-baseline > peak {
+			peak = stats.HeapAlloc - baseline
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read != loadTestWarrants {
+		t.Fatalf("expected %d warrants, got %d", loadTestWarrants, read)
+	}
+
+	// a batch of warrants and the decoder's buffer are all that should be
+	// live, so the heap, garbage included, should stay well below the size of
+	// the response
+	t.Logf("read %d warrants from a %d byte response with a peak heap growth of %d bytes", read, size, peak)
+	if peak > size/4 {
+		t.Fatalf("expected peak heap growth below %d bytes, got %d", size/4, peak)
+	}
+}
+
+// signTestEvent returns an event of the given type adding warrants, signed
+// with privateKey at signedAt.
+func signTestEvent(t *testing.T, privateKey ed25519.PrivateKey, eventType string, signedAt time.Time, warrants WarrantSet) *sse.Event {
+	t.Helper()
+
+	payload, err := json.Marshal(warrants)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := signedEvent{
+		Payload:  payload,
+		SignedAt: signedAt.UTC().Format(time.RFC3339Nano),
+	}
+	signed.Signature = signTestMessage(privateKey, []byte(eventType), []byte(signed.SignedAt), payload)
+	data, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sse.Event{
+		Event: []byte(eventType),
+		Data:  data,
+	}
+}
+
+func signTestMessage(privateKey ed25519.PrivateKey, parts ...[]byte) string {
+	message := bytes.Join(parts, []byte("\n"))
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, message))
+}
+
+// signTestDigest signs the given parts of a message separated by newlines with
+// Ed25519ph, as the Warrant API signs expand responses.
+func signTestDigest(t *testing.T, privateKey ed25519.PrivateKey, parts ...[]byte) string {
+	t.Helper()
+
+	digest := sha512.Sum512(bytes.Join(parts, []byte("\n")))
+	signature, err := privateKey.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func otherTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey
+}
@@ -0,0 +1,378 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/warrant-dev/edge"
+)
+
+var (
+	ErrNoOfflineDatastore = errors.New("only a redis datastore can be inspected without a running agent (use --file to inspect a dump)")
+	ErrUnknownTenant      = errors.New("unknown tenant")
+	ErrWarrantNotFound    = errors.New("warrant not found")
+	ErrCacheDiffers       = errors.New("cache differs from the Warrant API")
+)
+
+// dumpEntry is a line of the JSON lines file written by cache dump.
+type dumpEntry struct {
+	Warrant edge.WarrantKey `json:"warrant"`
+	Count   uint16          `json:"count"`
+}
+
+func newCacheCommand() *cobra.Command {
+	var file string
+	var tenant string
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect the warrants in the agent's cache",
+	}
+	cacheCmd.PersistentFlags().StringVar(&file, "file", "", "inspect a snapshot or a file written by 'cache dump' instead of the configured datastore")
+	cacheCmd.PersistentFlags().StringVar(&tenant, "tenant", "", "inspect the cache of the given tenant")
+
+	var output string
+	var snapshot bool
+	dumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Export every warrant in the cache as JSON lines",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo, err := openRepository(file, tenant)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if output != "" {
+				outputFile, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer outputFile.Close()
+				out = outputFile
+			}
+
+			if snapshot {
+				return edge.ExportSnapshot(out, repo)
+			}
+
+			return dumpRepository(repo, out)
+		},
+	}
+	dumpCmd.Flags().StringVarP(&output, "output", "o", "", "file to write the dump to (default stdout)")
+	dumpCmd.Flags().BoolVar(&snapshot, "snapshot", false, "write a snapshot that SNAPSHOT_FILE can be loaded from instead of JSON lines")
+
+	cacheCmd.AddCommand(
+		dumpCmd,
+		&cobra.Command{
+			Use:   "get <warrant>",
+			Short: "Look up a warrant, such as document:1#viewer@user:1, in the cache",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				key, err := edge.ParseWarrantKey(args[0])
+				if err != nil {
+					return err
+				}
+
+				repo, err := openRepository(file, tenant)
+				if err != nil {
+					return err
+				}
+
+				return getWarrant(cmd, repo, key)
+			},
+		},
+		&cobra.Command{
+			Use:   "stats",
+			Short: "Count the warrants in the cache by object type and relation",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				repo, err := openRepository(file, tenant)
+				if err != nil {
+					return err
+				}
+
+				return printStats(cmd, repo)
+			},
+		},
+		&cobra.Command{
+			Use:   "diff",
+			Short: "Compare the cache against a fresh download from the Warrant API",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				repo, err := openRepository(file, tenant)
+				if err != nil {
+					return err
+				}
+
+				return diffRepository(cmd, repo, tenant)
+			},
+		},
+	)
+
+	return cacheCmd
+}
+
+// openRepository opens the repository of the given tenant, or of the agent's
+// environment if tenant is empty, or loads the given dump file into memory.
+func openRepository(file string, tenant string) (edge.IExportableRepository, error) {
+	if file != "" {
+		return readDump(file)
+	}
+
+	if viper.GetString(PropertyDatastore) != edge.DatastoreRedis {
+		return nil, ErrNoOfflineDatastore
+	}
+
+	namespace := viper.GetString(PropertyRedisNamespace)
+	if tenant != "" {
+		namespace = tenantNamespace(tenant)
+	}
+
+	apiKey, err := tenantApiKey(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// only inspect the namespace, leaving claiming it to the agent syncing it
+	return edge.OpenRedisRepository(edge.RedisRepositoryConfig{
+		Hostname:  viper.GetString(PropertyRedisHostname),
+		Password:  viper.GetString(PropertyRedisPassword),
+		Port:      viper.GetString(PropertyRedisPort),
+		Database:  viper.GetInt(PropertyRedisDatabase),
+		Namespace: namespace,
+		ApiKey:    apiKey,
+	})
+}
+
+// tenantApiKey returns the API key of the given tenant, or of the agent's
+// environment if tenant is empty.
+func tenantApiKey(tenant string) (string, error) {
+	if tenant == "" {
+		return viper.GetString(PropertyApiKey), nil
+	}
+
+	if !slices.Contains(splitList(viper.GetString(PropertyTenants)), tenant) {
+		return "", fmt.Errorf("%w %s", ErrUnknownTenant, tenant)
+	}
+
+	return viper.GetString(tenantProperty(tenant, PropertyApiKey)), nil
+}
+
+// readDump loads a snapshot or a file written by cache dump into memory.
+func readDump(file string) (edge.IExportableRepository, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	repo := edge.NewMemoryRepository()
+	reader := bufio.NewReader(f)
+	if magic, _ := reader.Peek(2); edge.IsSnapshot(magic) {
+		err = edge.ImportSnapshot(reader, repo)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", file, err)
+		}
+
+		return repo, nil
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry dumpEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return repo, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", file, err)
+		}
+
+		err = repo.Set(entry.Warrant, entry.Count)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func dumpRepository(repo edge.IExportableRepository, out io.Writer) error {
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	err := repo.Range(func(key edge.WarrantKey, count uint16) error {
+		return encoder.Encode(dumpEntry{
+			Warrant: key,
+			Count:   count,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func getWarrant(cmd *cobra.Command, repo edge.IExportableRepository, key edge.WarrantKey) error {
+	found, err := repo.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		fmt.Fprintln(cmd.OutOrStdout(), key)
+	}
+
+	// list the policies the warrant is also granted with
+	policies, err := repo.GetPolicies([]edge.WarrantKey{key.WithoutPolicy()})
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies[0] {
+		if policy != key.Policy {
+			key.Policy = policy
+			fmt.Fprintln(cmd.OutOrStdout(), key)
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrWarrantNotFound, key)
+	}
+
+	return nil
+}
+
+func printStats(cmd *cobra.Command, repo edge.IExportableRepository) error {
+	type objectRelation struct {
+		objectType string
+		relation   string
+	}
+
+	counts := make(map[objectRelation]int)
+	total := 0
+	err := repo.Range(func(key edge.WarrantKey, count uint16) error {
+		counts[objectRelation{key.ObjectType, key.Relation}]++
+		total++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	objectRelations := make([]objectRelation, 0, len(counts))
+	for or := range counts {
+		objectRelations = append(objectRelations, or)
+	}
+	sort.Slice(objectRelations, func(i, j int) bool {
+		if objectRelations[i].objectType != objectRelations[j].objectType {
+			return objectRelations[i].objectType < objectRelations[j].objectType
+		}
+
+		return objectRelations[i].relation < objectRelations[j].relation
+	})
+
+	writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "OBJECT TYPE\tRELATION\tWARRANTS")
+	for _, or := range objectRelations {
+		fmt.Fprintf(writer, "%s\t%s\t%d\n", or.objectType, or.relation, counts[or])
+	}
+	fmt.Fprintf(writer, "TOTAL\t\t%d\n", total)
+	return writer.Flush()
+}
+
+// diffRepository prints the warrants the repository is missing (-), should not
+// have (+) or has the wrong count of (~) compared to the Warrant API.
+func diffRepository(cmd *cobra.Command, repo edge.IExportableRepository, tenant string) error {
+	apiKey, err := tenantApiKey(tenant)
+	if err != nil {
+		return err
+	}
+
+	var objectTypes *edge.ObjectTypeFilter
+	if viper.GetString(PropertySyncObjectTypes) != "" {
+		objectTypes, err = edge.NewObjectTypeFilter(splitList(viper.GetString(PropertySyncObjectTypes)))
+		if err != nil {
+			return err
+		}
+	}
+
+	var publicKey ed25519.PublicKey
+	if viper.GetString(PropertySignaturePublicKey) != "" {
+		publicKey, err = edge.ParsePublicKey(viper.GetString(PropertySignaturePublicKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err := edge.NewClient(edge.ClientConfig{
+		ApiKey:      apiKey,
+		ApiEndpoint: viper.GetString(PropertyApiEndpoint),
+		PublicKey:   publicKey,
+		ObjectTypes: objectTypes,
+	})
+	if err != nil {
+		return err
+	}
+
+	expected, err := client.GetWarrants()
+	if err != nil {
+		return err
+	}
+
+	differences := make([]string, 0)
+	err = repo.Range(func(key edge.WarrantKey, count uint16) error {
+		expectedCount, ok := expected[key]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("+ %s", key))
+		} else if count != expectedCount {
+			differences = append(differences, fmt.Sprintf("~ %s (cache %d, Warrant API %d)", key, count, expectedCount))
+		}
+
+		delete(expected, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range expected {
+		differences = append(differences, fmt.Sprintf("- %s", key))
+	}
+
+	if len(differences) == 0 {
+		fmt.Fprintln(cmd.OutOrStdout(), "Cache matches the Warrant API")
+		return nil
+	}
+
+	sort.Strings(differences)
+	for _, difference := range differences {
+		fmt.Fprintln(cmd.OutOrStdout(), difference)
+	}
+
+	return fmt.Errorf("%w: %d differences", ErrCacheDiffers, len(differences))
+}
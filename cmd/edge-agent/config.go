@@ -0,0 +1,224 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/warrant-dev/edge"
+)
+
+const redacted = "********"
+
+var (
+	ErrInvalidNumber  = errors.New("must be a number")
+	ErrInvalidBoolean = errors.New("must be true or false")
+)
+
+// secretProperties are redacted when printing the configuration, along with
+// each tenant's API keys.
+var secretProperties = []string{
+	PropertyApiKey,
+	PropertyClientApiKeys,
+	PropertyRedisPassword,
+}
+
+var numberProperties = []string{
+	PropertyRedisDatabase,
+	PropertyLocalCacheSize,
+	PropertyLocalCacheTTL,
+	PropertyUpstreamTimeout,
+	PropertyPort,
+	PropertyAdminPort,
+	PropertyHealthPort,
+	PropertyGrpcPort,
+}
+
+var booleanProperties = []string{
+	PropertyRedisPublish,
+	PropertyReadOnly,
+	PropertyLeaderElection,
+	PropertyUpstreamFallback,
+	PropertyDisableAuth,
+	PropertyDisableRequestLogs,
+}
+
+func newConfigCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the agent's configuration",
+	}
+	configCmd.AddCommand(
+		&cobra.Command{
+			Use:   "validate",
+			Short: "Check the configuration for errors without starting the agent",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if err := validateConfig(); err != nil {
+					return err
+				}
+
+				fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid")
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "print",
+			Short: "Print the configuration the agent would run with, with secrets redacted",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				for _, property := range properties {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s=%s\n", property, printableValue(property, slices.Contains(secretProperties, property)))
+				}
+
+				for _, property := range tenantProperties() {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s=%s\n", property, printableValue(property, true))
+				}
+			},
+		},
+	)
+
+	return configCmd
+}
+
+func printableValue(property string, secret bool) string {
+	value := viper.GetString(property)
+	if secret && value != "" {
+		return redacted
+	}
+
+	return value
+}
+
+// validateConfig checks the configuration for every error the agent would
+// otherwise only report on startup, returning all of them.
+func validateConfig() error {
+	errs := make([]error, 0)
+	for _, property := range numberProperties {
+		if value := viper.GetString(property); value != "" {
+			if _, err := strconv.Atoi(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", property, ErrInvalidNumber))
+			}
+		}
+	}
+
+	for _, property := range booleanProperties {
+		if value := viper.GetString(property); value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", property, ErrInvalidBoolean))
+			}
+		}
+	}
+
+	datastore := viper.GetString(PropertyDatastore)
+	if datastore != "" && datastore != edge.DatastoreMemory && datastore != edge.DatastoreRedis {
+		errs = append(errs, fmt.Errorf("%s: %w", PropertyDatastore, ErrInvalidDatastoreType))
+	}
+
+	if viper.GetBool(PropertyLeaderElection) && datastore != edge.DatastoreRedis {
+		errs = append(errs, fmt.Errorf("%s: %w", PropertyLeaderElection, edge.ErrMissingLeaderElectionRepository))
+	}
+
+	updateStrategy := viper.GetString(PropertyUpdateStrategy)
+	fileUpdates := strings.EqualFold(updateStrategy, edge.UpdateStrategyFile)
+	if updateStrategy != "" && !strings.EqualFold(updateStrategy, edge.UpdateStrategyPolling) && !strings.EqualFold(updateStrategy, edge.UpdateStrategyStreaming) && !fileUpdates {
+		errs = append(errs, fmt.Errorf("%s: %w", PropertyUpdateStrategy, edge.ErrInvalidUpdateStrategy))
+	}
+
+	if fileUpdates && !viper.GetBool(PropertyReadOnly) {
+		if viper.GetString(PropertyUpdateDirectory) == "" {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertyUpdateDirectory, edge.ErrMissingUpdateDirectory))
+		} else if _, err := os.Stat(viper.GetString(PropertyUpdateDirectory)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertyUpdateDirectory, err))
+		}
+
+		if viper.GetString(PropertySignaturePublicKey) == "" {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertySignaturePublicKey, edge.ErrMissingPublicKey))
+		}
+	}
+
+	if value := viper.GetString(PropertySignaturePublicKey); value != "" {
+		if _, err := edge.ParsePublicKey(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertySignaturePublicKey, err))
+		}
+	}
+
+	if value := viper.GetString(PropertyPollingFrequency); value != "" {
+		if pollingFrequency, err := strconv.Atoi(value); err != nil || pollingFrequency < 10 {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertyPollingFrequency, edge.ErrInvalidPollingFrequency))
+		}
+	}
+
+	if value := viper.GetString(PropertySocketMode); value != "" {
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertySocketMode, ErrInvalidSocketMode))
+		}
+	}
+
+	if value := viper.GetString(PropertySyncObjectTypes); value != "" {
+		if _, err := edge.NewObjectTypeFilter(splitList(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertySyncObjectTypes, err))
+		}
+	}
+
+	snapshotFiles := []string{PropertySnapshotFile}
+	for _, name := range splitList(viper.GetString(PropertyTenants)) {
+		snapshotFiles = append(snapshotFiles, tenantProperty(name, PropertySnapshotFile))
+	}
+	for _, property := range snapshotFiles {
+		if value := viper.GetString(property); value != "" {
+			if _, err := os.Stat(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", property, err))
+			}
+		}
+	}
+
+	certFile := viper.GetString(PropertyTLSCertFile)
+	if (certFile == "") != (viper.GetString(PropertyTLSKeyFile) == "") || (viper.GetString(PropertyTLSClientCAFile) != "" && certFile == "") {
+		errs = append(errs, edge.ErrIncompleteTLSConfig)
+	}
+
+	// API keys are needed to sync, forward checks and authenticate requests
+	needsApiKey := (!viper.GetBool(PropertyReadOnly) && !fileUpdates) || viper.GetBool(PropertyUpstreamFallback)
+	hasApiKeys := viper.GetString(PropertyApiKey) != "" || len(splitList(viper.GetString(PropertyClientApiKeys))) > 0
+	tenantNames := splitList(viper.GetString(PropertyTenants))
+	if len(tenantNames) == 0 {
+		// without any API keys the server warns and serves checks without
+		// authentication
+		if needsApiKey && viper.GetString(PropertyApiKey) == "" {
+			errs = append(errs, fmt.Errorf("%s: %w", PropertyApiKey, edge.ErrMissingApiKey))
+		}
+	}
+
+	for i, name := range tenantNames {
+		apiKeyProperty := tenantProperty(name, PropertyApiKey)
+		if slices.Contains(tenantNames[:i], name) {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", name, edge.ErrDuplicateTenantName))
+		} else if needsApiKey && viper.GetString(apiKeyProperty) == "" {
+			errs = append(errs, fmt.Errorf("%s: %w", apiKeyProperty, edge.ErrMissingApiKey))
+		} else if !viper.GetBool(PropertyDisableAuth) && !hasApiKeys && viper.GetString(apiKeyProperty) == "" && len(splitList(viper.GetString(tenantProperty(name, PropertyClientApiKeys)))) == 0 {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", name, edge.ErrMissingApiKey))
+		}
+	}
+
+	return errors.Join(errs...)
+}
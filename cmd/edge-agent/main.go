@@ -16,104 +16,218 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"os"
+	"slices"
+	"strings"
 
-	"github.com/warrant-dev/edge"
-
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
-	PropertyApiEndpoint       = "API_ENDPOINT"
-	PropertyApiKey            = "API_KEY"
-	PropertyDatastore         = "DATASTORE"
-	PropertyRedisHostname     = "REDIS_HOSTNAME"
-	PropertyRedisPassword     = "REDIS_PASSWORD"
-	PropertyRedisPort         = "REDIS_PORT"
-	PropertyRedisDatabase     = "REDIS_DATABASE"
-	PropertyStreamingEndpoint = "STREAMING_ENDPOINT"
-	PropertyUpdateStrategy    = "UPDATE_STRATEGY"
-	PropertyPollingFrequency  = "POLLING_FREQUENCY"
-	PropertyReadOnly          = "READ_ONLY"
+	PropertyApiEndpoint        = "API_ENDPOINT"
+	PropertyApiKey             = "API_KEY"
+	PropertyDatastore          = "DATASTORE"
+	PropertyRedisHostname      = "REDIS_HOSTNAME"
+	PropertyRedisPassword      = "REDIS_PASSWORD"
+	PropertyRedisPort          = "REDIS_PORT"
+	PropertyRedisDatabase      = "REDIS_DATABASE"
+	PropertyRedisNamespace     = "REDIS_NAMESPACE"
+	PropertyRedisPublish       = "REDIS_PUBLISH_INVALIDATIONS"
+	PropertyLocalCacheSize     = "LOCAL_CACHE_SIZE"
+	PropertyLocalCacheTTL      = "LOCAL_CACHE_TTL"
+	PropertyStreamingEndpoint  = "STREAMING_ENDPOINT"
+	PropertyUpdateStrategy     = "UPDATE_STRATEGY"
+	PropertyPollingFrequency   = "POLLING_FREQUENCY"
+	PropertyUpdateDirectory    = "UPDATE_DIRECTORY"
+	PropertySignaturePublicKey = "SIGNATURE_PUBLIC_KEY"
+	PropertyReadOnly           = "READ_ONLY"
+	PropertyLeaderElection     = "LEADER_ELECTION"
+	PropertyUpstreamFallback   = "UPSTREAM_FALLBACK"
+	PropertyUpstreamTimeout    = "UPSTREAM_TIMEOUT_MS"
+	PropertyClientApiKeys      = "CLIENT_API_KEYS"
+	PropertyDisableAuth        = "DISABLE_AUTH"
+	PropertyDisableRequestLogs = "DISABLE_REQUEST_LOGS"
+	PropertyListenAddress      = "LISTEN_ADDRESS"
+	PropertyPort               = "PORT"
+	PropertySocketPath         = "SOCKET_PATH"
+	PropertySocketMode         = "SOCKET_MODE"
+	PropertyAdminAddress       = "ADMIN_LISTEN_ADDRESS"
+	PropertyAdminPort          = "ADMIN_PORT"
+	PropertyHealthPort         = "HEALTH_PORT" // deprecated, use ADMIN_PORT
+	PropertyGrpcPort           = "GRPC_PORT"
+	PropertyTLSCertFile        = "TLS_CERT_FILE"
+	PropertyTLSKeyFile         = "TLS_KEY_FILE"
+	PropertyTLSClientCAFile    = "TLS_CLIENT_CA_FILE"
+	PropertySyncObjectTypes    = "SYNC_OBJECT_TYPES"
+	PropertyTenants            = "TENANTS"
+	PropertySnapshotFile       = "SNAPSHOT_FILE"
+)
+
+// properties are the settings the agent reads from agent.properties or, failing
+// that, the environment.
+var properties = []string{
+	PropertyApiKey,
+	PropertyApiEndpoint,
+	PropertyUpdateStrategy,
+	PropertyPollingFrequency,
+	PropertyStreamingEndpoint,
+	PropertyUpdateDirectory,
+	PropertySignaturePublicKey,
+	PropertyDatastore,
+	PropertyRedisHostname,
+	PropertyRedisPort,
+	PropertyRedisPassword,
+	PropertyRedisDatabase,
+	PropertyRedisNamespace,
+	PropertyRedisPublish,
+	PropertyLocalCacheSize,
+	PropertyLocalCacheTTL,
+	PropertyReadOnly,
+	PropertyLeaderElection,
+	PropertyUpstreamFallback,
+	PropertyUpstreamTimeout,
+	PropertyClientApiKeys,
+	PropertyDisableAuth,
+	PropertyDisableRequestLogs,
+	PropertyListenAddress,
+	PropertyPort,
+	PropertySocketPath,
+	PropertySocketMode,
+	PropertyAdminAddress,
+	PropertyAdminPort,
+	PropertyHealthPort,
+	PropertyGrpcPort,
+	PropertyTLSCertFile,
+	PropertyTLSKeyFile,
+	PropertyTLSClientCAFile,
+	PropertySyncObjectTypes,
+	PropertyTenants,
+	PropertySnapshotFile,
+}
+
+var (
+	ErrInvalidDatastoreType = errors.New("invalid datastore type")
+	ErrInvalidSocketMode    = errors.New("invalid socket mode (must be octal, e.g. 0660)")
 )
 
-var ErrInvalidDatastoreType = errors.New("invalid datastore type")
+// version, commit and date are set at build time.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
 
 func main() {
-	viper.SetConfigName("agent")
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newRootCommand returns the edge-agent command, which serves authorization
+// requests if no subcommand is given.
+func newRootCommand() *cobra.Command {
+	var configFile string
+	rootCmd := &cobra.Command{
+		Use:          "edge-agent",
+		Short:        "Serve Warrant authorization checks from a local cache",
+		Version:      version,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConfig(configFile)
+		},
+		RunE: serve,
+	}
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "path to a properties file to read configuration from (default ./agent.properties)")
+	rootCmd.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Sync warrants and serve authorization checks",
+			Args:  cobra.NoArgs,
+			RunE:  serve,
+		},
+		newVersionCommand(),
+		newConfigCommand(),
+		newCacheCommand(),
+	)
+
+	return rootCmd
+}
+
+// loadConfig reads configuration from the given properties file, or
+// ./agent.properties if it exists, falling back to environment variables for
+// properties the file does not set.
+func loadConfig(configFile string) error {
 	viper.SetConfigType("properties")
-	viper.AddConfigPath(".")
-	viper.SetDefault(PropertyApiKey, os.Getenv(PropertyApiKey))
-	viper.SetDefault(PropertyApiEndpoint, os.Getenv(PropertyApiEndpoint))
-	viper.SetDefault(PropertyUpdateStrategy, os.Getenv(PropertyUpdateStrategy))
-	viper.SetDefault(PropertyPollingFrequency, os.Getenv(PropertyPollingFrequency))
-	viper.SetDefault(PropertyStreamingEndpoint, os.Getenv(PropertyStreamingEndpoint))
-	viper.SetDefault(PropertyDatastore, os.Getenv(PropertyDatastore))
-	viper.SetDefault(PropertyRedisHostname, os.Getenv(PropertyRedisHostname))
-	viper.SetDefault(PropertyRedisPort, os.Getenv(PropertyRedisPort))
-	viper.SetDefault(PropertyRedisPassword, os.Getenv(PropertyRedisPassword))
-	viper.SetDefault(PropertyRedisDatabase, os.Getenv(PropertyRedisDatabase))
-	viper.SetDefault(PropertyReadOnly, os.Getenv(PropertyReadOnly))
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigName("agent")
+		viper.AddConfigPath(".")
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		if errors.Is(err, viper.ConfigFileNotFoundError{}) {
-			log.Fatal(err)
+	for _, property := range properties {
+		if value, ok := propertyDefaults[property]; ok && os.Getenv(property) == "" {
+			viper.SetDefault(property, value)
+		} else {
+			viper.SetDefault(property, os.Getenv(property))
 		}
 	}
 
-	var repo edge.IRepository
-	var err error
-	switch viper.GetString(PropertyDatastore) {
-	case "":
-		repo = edge.NewMemoryRepository()
-	case edge.DatastoreMemory:
-		repo = edge.NewMemoryRepository()
-	case edge.DatastoreRedis:
-		repo, err = edge.NewRedisRepository(edge.RedisRepositoryConfig{
-			Hostname: viper.GetString(PropertyRedisHostname),
-			Password: viper.GetString(PropertyRedisPassword),
-			Port:     viper.GetString(PropertyRedisPort),
-			Database: viper.GetInt(PropertyRedisDatabase),
-		})
-		if err != nil {
-			log.Fatal(err)
+	if err := viper.ReadInConfig(); err != nil {
+		var notFoundErr viper.ConfigFileNotFoundError
+		if configFile != "" || !errors.As(err, &notFoundErr) {
+			return fmt.Errorf("error reading configuration: %w", err)
 		}
-	default:
-		log.Fatal(ErrInvalidDatastoreType)
 	}
 
-	// initialize and start client
-	if !viper.GetBool(PropertyReadOnly) {
-		log.Println("Starting edge agent")
-		client, err := edge.NewClient(edge.ClientConfig{
-			ApiKey:            viper.GetString(PropertyApiKey),
-			ApiEndpoint:       viper.GetString(PropertyApiEndpoint),
-			StreamingEndpoint: viper.GetString(PropertyStreamingEndpoint),
-			UpdateStrategy:    viper.GetString(PropertyUpdateStrategy),
-			PollingFrequency:  viper.GetInt(PropertyPollingFrequency),
-			Repository:        repo,
-		})
-		if err != nil {
-			log.Fatal(err)
+	for _, property := range tenantProperties() {
+		viper.SetDefault(property, os.Getenv(property))
+	}
+
+	return nil
+}
+
+// propertyDefaults are the values of the properties that aren't empty by
+// default.
+var propertyDefaults = map[string]string{
+	// agents reading through a local cache rely on writers publishing
+	// invalidations to see changes before their cached results expire
+	PropertyRedisPublish: "true",
+}
+
+// tenantProperties returns the per-tenant properties of the tenants the agent
+// is configured to serve.
+func tenantProperties() []string {
+	tenantProperties := make([]string, 0)
+	for _, name := range splitList(viper.GetString(PropertyTenants)) {
+		if slices.Contains(tenantProperties, tenantProperty(name, PropertyApiKey)) {
+			continue
 		}
 
-		go func() {
-			log.Fatal(client.Run())
-		}()
-	} else {
-		log.Println("Starting edge agent in read-only mode")
+		tenantProperties = append(tenantProperties, tenantProperty(name, PropertyApiKey), tenantProperty(name, PropertyClientApiKeys), tenantProperty(name, PropertySnapshotFile))
 	}
 
-	// initialize and start server
-	server, err := edge.NewServer(edge.ServerConfig{
-		Port:       3000,
-		ApiKey:     viper.GetString(PropertyApiKey),
-		Repository: repo,
-	})
-	if err != nil {
-		log.Fatal(err)
+	return tenantProperties
+}
+
+// tenantProperty returns the name of a property for the given tenant, such as
+// TENANT_ACME_API_KEY.
+func tenantProperty(name string, property string) string {
+	return fmt.Sprintf("TENANT_%s_%s", strings.ToUpper(strings.ReplaceAll(name, "-", "_")), property)
+}
+
+// splitList splits a comma-separated property value, ignoring empty entries.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
 	}
 
-	log.Fatal(server.Run())
+	return items
 }
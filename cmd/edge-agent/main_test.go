@@ -0,0 +1,168 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCommandOutput checks that commands meant to be piped or redirected,
+// such as edge-agent config print > agent.properties, write their output to
+// stdout rather than stderr, where cobra's Print functions write.
+func TestCommandOutput(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "agent.properties")
+	err := os.WriteFile(configFile, []byte("API_KEY=secret\nPORT=3001\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{
+			args:     []string{"version"},
+			expected: "edge-agent dev",
+		},
+		{
+			args:     []string{"--config", configFile, "config", "validate"},
+			expected: "Configuration is valid",
+		},
+		{
+			args:     []string{"--config", configFile, "config", "print"},
+			expected: "PORT=3001",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			// capture the process's stdout and stderr, since setting the
+			// command's output would send cobra's Print functions there too
+			stdout := captureOutput(t, &os.Stdout)
+			stderr := captureOutput(t, &os.Stderr)
+			cmd := newRootCommand()
+			cmd.SetArgs(test.args)
+			err := cmd.Execute()
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Stdout.Close()
+			os.Stderr.Close()
+			<-stdout.done
+			<-stderr.done
+
+			if !strings.Contains(stdout.String(), test.expected) {
+				t.Errorf("expected stdout to contain %q, got %q", test.expected, stdout.String())
+			}
+
+			if stderr.Len() > 0 {
+				t.Errorf("expected nothing on stderr, got %q", stderr.String())
+			}
+		})
+	}
+}
+
+type capturedOutput struct {
+	bytes.Buffer
+	done chan struct{}
+}
+
+// captureOutput replaces the file f points to with a pipe until the test ends,
+// collecting what is written to it until it is closed.
+func captureOutput(t *testing.T, f **os.File) *capturedOutput {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := *f
+	*f = w
+	t.Cleanup(func() {
+		*f = original
+	})
+
+	output := &capturedOutput{
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(output.done)
+		output.ReadFrom(r)
+	}()
+
+	return output
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "agent.properties")
+	err := os.WriteFile(configFile, []byte("PORT=3000\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan struct{}, 16)
+	err = watchConfigFile(configFile, func() {
+		changes <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectChange := func(change string) {
+		t.Helper()
+
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s to be noticed", change)
+		}
+
+		// drain the rest of the events for the same change
+		for {
+			select {
+			case <-changes:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "other.properties"), []byte("PORT=3002\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Fatal("expected changes to other files to be ignored")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = os.WriteFile(configFile, []byte("PORT=3001\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange("a write")
+
+	err = os.Rename(filepath.Join(dir, "other.properties"), configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange("a replacement")
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/warrant-dev/edge"
+)
+
+// liveProperties are applied on reload, along with tenants' API keys. All
+// other properties, log settings included, apply on restart.
+var liveProperties = []string{
+	PropertyApiKey,
+	PropertyClientApiKeys,
+	PropertyPollingFrequency,
+	PropertyDisableRequestLogs,
+}
+
+// environment is an environment the agent syncs and serves, along with the
+// properties holding its API keys and the API key currently applied.
+type environment struct {
+	apiKeyProperty        string
+	clientApiKeysProperty string
+	apiKey                string
+	redisRepository       *edge.RedisRepository
+	client                *edge.Client
+	upstream              *edge.Upstream
+	tenant                *edge.Tenant
+}
+
+// reloader applies changes to the agent's configuration while it is running.
+type reloader struct {
+	server       *edge.Server
+	environments []*environment
+	settings     map[string]string
+	lock         sync.Mutex
+}
+
+func newReloader(server *edge.Server, environments []*environment) *reloader {
+	return &reloader{
+		server:       server,
+		environments: environments,
+		settings:     currentSettings(),
+	}
+}
+
+// watch reloads the configuration whenever agent.properties changes or the
+// agent receives SIGHUP.
+func (r *reloader) watch() {
+	if configFile := viper.ConfigFileUsed(); configFile != "" {
+		err := watchConfigFile(configFile, func() {
+			log.Printf("Configuration file %s changed. Reloading configuration.", configFile)
+			r.reload()
+		})
+		if err != nil {
+			log.Printf("Error watching configuration file %s, send SIGHUP to reload it: %s", configFile, err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Println("Received SIGHUP. Reloading configuration.")
+			r.reload()
+		}
+	}()
+}
+
+// watchConfigFile calls onChange whenever configFile is written or replaced.
+func watchConfigFile(configFile string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	configFile = filepath.Clean(configFile)
+	err = watcher.Add(filepath.Dir(configFile))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				written := filepath.Clean(event.Name) == configFile && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+				if written || (currentConfigFile != "" && currentConfigFile != realConfigFile) {
+					realConfigFile = currentConfigFile
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Printf("Error watching configuration file %s: %s", configFile, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reload applies a valid configuration's live changes and logs the ones that
+// require a restart.
+func (r *reloader) reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if viper.ConfigFileUsed() != "" {
+		err := viper.ReadInConfig()
+		if err != nil {
+			log.Printf("Error reading configuration, keeping current settings: %s", err)
+			return
+		}
+	}
+
+	err := validateConfig()
+	if err != nil {
+		log.Printf("Invalid configuration, keeping current settings: %s", err)
+		return
+	}
+
+	pollingFrequency := viper.GetInt(PropertyPollingFrequency)
+	for _, env := range r.environments {
+		apiKey := viper.GetString(env.apiKeyProperty)
+		if apiKey != env.apiKey && env.redisRepository != nil && env.apiKey != "" && apiKey != "" {
+			// let the new key claim the namespace the next time the agent
+			// starts
+			if err := env.redisRepository.TransferNamespace(env.apiKey, apiKey); err != nil {
+				log.Printf("Error transferring redis namespace to the new API key, delete it or its owner key before restarting: %s", err)
+			}
+		}
+		env.apiKey = apiKey
+
+		if env.client != nil {
+			if err := env.client.SetApiKey(apiKey); err != nil {
+				log.Println(err)
+			}
+
+			if err := env.client.SetPollingFrequency(pollingFrequency); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if env.upstream != nil {
+			if err := env.upstream.SetApiKey(apiKey); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if env.tenant != nil {
+			env.tenant.SetApiKeys(apiKey, splitList(viper.GetString(env.clientApiKeysProperty)))
+		}
+	}
+
+	err = r.server.SetApiKeys(viper.GetString(PropertyApiKey), splitList(viper.GetString(PropertyClientApiKeys)))
+	if err != nil {
+		log.Println(err)
+	}
+
+	r.server.SetRequestLogs(!viper.GetBool(PropertyDisableRequestLogs))
+
+	// compare against the settings the agent started with so that pending
+	// changes are reported until it is restarted
+	for property, value := range currentSettings() {
+		if value != r.settings[property] && !slices.Contains(liveProperties, property) {
+			log.Printf("%s has changed. Restart the edge agent to apply it.", property)
+		}
+	}
+
+	log.Println("Configuration reloaded")
+}
+
+func currentSettings() map[string]string {
+	settings := make(map[string]string, len(properties))
+	for _, property := range properties {
+		settings[property] = viper.GetString(property)
+	}
+
+	return settings
+}
@@ -0,0 +1,331 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/warrant-dev/edge"
+)
+
+// serve syncs the environments the agent is configured for and serves
+// authorization requests from them.
+func serve(cmd *cobra.Command, args []string) error {
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	// optionally sync and serve only a subset of object types
+	var objectTypes *edge.ObjectTypeFilter
+	var err error
+	if viper.GetString(PropertySyncObjectTypes) != "" {
+		objectTypes, err = edge.NewObjectTypeFilter(splitList(viper.GetString(PropertySyncObjectTypes)))
+		if err != nil {
+			return err
+		}
+	}
+
+	var repo edge.IRepository
+	var upstream *edge.Upstream
+	var client *edge.Client
+	tenants := make([]*edge.Tenant, 0)
+	environments := make([]*environment, 0)
+	tenantNames := splitList(viper.GetString(PropertyTenants))
+	if len(tenantNames) == 0 {
+		var redisRepo *edge.RedisRepository
+		repo, redisRepo, client = startEnvironment(viper.GetString(PropertyApiKey), viper.GetString(PropertyRedisNamespace), viper.GetString(PropertySnapshotFile), viper.GetString(PropertyUpdateDirectory), objectTypes)
+		upstream = newUpstream(viper.GetString(PropertyApiKey))
+		environments = append(environments, &environment{
+			apiKeyProperty:  PropertyApiKey,
+			apiKey:          viper.GetString(PropertyApiKey),
+			redisRepository: redisRepo,
+			client:          client,
+			upstream:        upstream,
+		})
+	} else {
+		// sync each tenant into its own namespace
+		for _, name := range tenantNames {
+			apiKeyProperty := tenantProperty(name, PropertyApiKey)
+			clientApiKeysProperty := tenantProperty(name, PropertyClientApiKeys)
+
+			log.Printf("Starting tenant %s", name)
+			tenantRepo, tenantRedisRepo, client := startEnvironment(viper.GetString(apiKeyProperty), tenantNamespace(name), viper.GetString(tenantProperty(name, PropertySnapshotFile)), tenantUpdateDirectory(name), objectTypes)
+			tenantUpstream := newUpstream(viper.GetString(apiKeyProperty))
+			tenant, err := edge.NewTenant(edge.TenantConfig{
+				Name:          name,
+				ApiKey:        viper.GetString(apiKeyProperty),
+				ClientApiKeys: splitList(viper.GetString(clientApiKeysProperty)),
+				Repository:    tenantRepo,
+				Upstream:      tenantUpstream,
+				Client:        client,
+			})
+			if err != nil {
+				return err
+			}
+
+			tenants = append(tenants, tenant)
+			environments = append(environments, &environment{
+				apiKeyProperty:        apiKeyProperty,
+				clientApiKeysProperty: clientApiKeysProperty,
+				apiKey:                viper.GetString(apiKeyProperty),
+				redisRepository:       tenantRedisRepo,
+				client:                client,
+				upstream:              tenantUpstream,
+				tenant:                tenant,
+			})
+		}
+	}
+
+	var socketMode uint64
+	if viper.GetString(PropertySocketMode) != "" {
+		socketMode, err = strconv.ParseUint(viper.GetString(PropertySocketMode), 8, 32)
+		if err != nil {
+			return ErrInvalidSocketMode
+		}
+	}
+
+	// initialize and start server
+	server, err := edge.NewServer(edge.ServerConfig{
+		ListenAddress:      viper.GetString(PropertyListenAddress),
+		Port:               viper.GetInt(PropertyPort),
+		SocketPath:         viper.GetString(PropertySocketPath),
+		SocketMode:         os.FileMode(socketMode),
+		AdminListenAddress: viper.GetString(PropertyAdminAddress),
+		AdminPort:          adminPort(),
+		GrpcPort:           viper.GetInt(PropertyGrpcPort),
+		TLSCertFile:        viper.GetString(PropertyTLSCertFile),
+		TLSKeyFile:         viper.GetString(PropertyTLSKeyFile),
+		TLSClientCAFile:    viper.GetString(PropertyTLSClientCAFile),
+		ApiKey:             viper.GetString(PropertyApiKey),
+		ClientApiKeys:      splitList(viper.GetString(PropertyClientApiKeys)),
+		DisableAuth:        viper.GetBool(PropertyDisableAuth),
+		DisableRequestLogs: viper.GetBool(PropertyDisableRequestLogs),
+		ObjectTypes:        objectTypes,
+		Repository:         repo,
+		Upstream:           upstream,
+		Client:             client,
+		Tenants:            tenants,
+	})
+	if err != nil {
+		return err
+	}
+
+	newReloader(server, environments).watch()
+	return server.Run()
+}
+
+// startEnvironment creates and seeds the repository of an API key's
+// environment and, unless the agent is read-only, starts syncing it.
+func startEnvironment(apiKey string, namespace string, snapshotFile string, updateDirectory string, objectTypes *edge.ObjectTypeFilter) (edge.IRepository, *edge.RedisRepository, *edge.Client) {
+	var repo edge.IRepository
+	var redisRepo *edge.RedisRepository
+	var err error
+	switch viper.GetString(PropertyDatastore) {
+	case "":
+		repo = edge.NewMemoryRepository()
+	case edge.DatastoreMemory:
+		repo = edge.NewMemoryRepository()
+	case edge.DatastoreRedis:
+		redisRepo, err = newRedisRepository(apiKey, namespace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		repo = redisRepo
+	default:
+		log.Fatal(ErrInvalidDatastoreType)
+	}
+
+	// optionally serve reads from a local cache in front of the datastore
+	if viper.GetInt(PropertyLocalCacheSize) > 0 {
+		cachedRepo, err := edge.NewCachedRepository(edge.CachedRepositoryConfig{
+			Size:       viper.GetInt(PropertyLocalCacheSize),
+			TTL:        time.Duration(viper.GetInt(PropertyLocalCacheTTL)) * time.Second,
+			Repository: repo,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if redisRepo != nil {
+			go func() {
+				log.Fatal(redisRepo.SubscribeInvalidations(context.Background(), cachedRepo.Invalidate))
+			}()
+		}
+
+		repo = cachedRepo
+	}
+
+	if snapshotFile != "" {
+		err = loadSnapshot(repo, snapshotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// initialize and start client
+	if viper.GetBool(PropertyReadOnly) {
+		log.Println("Starting edge agent in read-only mode")
+		return repo, redisRepo, nil
+	}
+
+	var publicKey ed25519.PublicKey
+	if viper.GetString(PropertySignaturePublicKey) != "" {
+		publicKey, err = edge.ParsePublicKey(viper.GetString(PropertySignaturePublicKey))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Println("Starting edge agent")
+	client, err := edge.NewClient(edge.ClientConfig{
+		ApiKey:            apiKey,
+		ApiEndpoint:       viper.GetString(PropertyApiEndpoint),
+		StreamingEndpoint: viper.GetString(PropertyStreamingEndpoint),
+		UpdateStrategy:    viper.GetString(PropertyUpdateStrategy),
+		PollingFrequency:  viper.GetInt(PropertyPollingFrequency),
+		UpdateDirectory:   updateDirectory,
+		PublicKey:         publicKey,
+		ObjectTypes:       objectTypes,
+		Repository:        repo,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if viper.GetBool(PropertyLeaderElection) {
+		election, err := edge.NewLeaderElection(edge.LeaderElectionConfig{
+			Repository: redisRepo,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Waiting to be elected leader before syncing warrants")
+		go func() {
+			log.Fatal(election.Run(context.Background(), func(ctx context.Context) {
+				err := client.RunWithContext(ctx)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}))
+		}()
+	} else {
+		go func() {
+			log.Fatal(client.Run())
+		}()
+	}
+
+	return repo, redisRepo, client
+}
+
+// loadSnapshot seeds a repository that has never been synced from a snapshot
+// file.
+func loadSnapshot(repo edge.IRepository, snapshotFile string) error {
+	lastSynced, err := repo.LastSynced()
+	if err != nil {
+		return fmt.Errorf("error getting last synced time: %w", err)
+	}
+
+	if !lastSynced.IsZero() {
+		log.Printf("Skipping snapshot %s, the repository was already synced at %s", snapshotFile, lastSynced.Format(time.RFC3339))
+		return nil
+	}
+
+	f, err := os.Open(snapshotFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = edge.ImportSnapshot(f, repo)
+	if err != nil {
+		return fmt.Errorf("error loading snapshot %s: %w", snapshotFile, err)
+	}
+
+	log.Printf("Loaded snapshot %s", snapshotFile)
+	return nil
+}
+
+func newRedisRepository(apiKey string, namespace string) (*edge.RedisRepository, error) {
+	return edge.NewRedisRepository(edge.RedisRepositoryConfig{
+		Hostname:             viper.GetString(PropertyRedisHostname),
+		Password:             viper.GetString(PropertyRedisPassword),
+		Port:                 viper.GetString(PropertyRedisPort),
+		Database:             viper.GetInt(PropertyRedisDatabase),
+		Namespace:            namespace,
+		ApiKey:               apiKey,
+		PublishInvalidations: viper.GetBool(PropertyRedisPublish),
+	})
+}
+
+// adminPort returns the port of the admin listener, falling back to the
+// deprecated HEALTH_PORT.
+func adminPort() int {
+	if viper.GetString(PropertyAdminPort) == "" && viper.GetString(PropertyHealthPort) != "" {
+		log.Printf("%s is deprecated. Use %s instead.", PropertyHealthPort, PropertyAdminPort)
+		return viper.GetInt(PropertyHealthPort)
+	}
+
+	return viper.GetInt(PropertyAdminPort)
+}
+
+// tenantNamespace returns the redis namespace a tenant is synced into, the
+// agent's namespace suffixed with the tenant's name.
+func tenantNamespace(name string) string {
+	namespace := viper.GetString(PropertyRedisNamespace)
+	if namespace == "" {
+		namespace = edge.DefaultRedisNamespace
+	}
+
+	return fmt.Sprintf("%s-%s", namespace, name)
+}
+
+// tenantUpdateDirectory returns the directory a tenant's update files are read
+// from, a subdirectory of UPDATE_DIRECTORY named after the tenant.
+func tenantUpdateDirectory(name string) string {
+	if viper.GetString(PropertyUpdateDirectory) == "" {
+		return ""
+	}
+
+	return filepath.Join(viper.GetString(PropertyUpdateDirectory), name)
+}
+
+// newUpstream returns the upstream checks the cache cannot answer are
+// forwarded to, if upstream fallback is enabled.
+func newUpstream(apiKey string) *edge.Upstream {
+	if !viper.GetBool(PropertyUpstreamFallback) {
+		return nil
+	}
+
+	upstream, err := edge.NewUpstream(edge.UpstreamConfig{
+		ApiKey:      apiKey,
+		ApiEndpoint: viper.GetString(PropertyApiEndpoint),
+		Timeout:     time.Duration(viper.GetInt(PropertyUpstreamTimeout)) * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return upstream
+}
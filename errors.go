@@ -15,13 +15,17 @@
 package edge
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/warrant-dev/warrant/pkg/service"
 )
 
 const (
-	ErrorCacheNotReady = "cache_not_ready"
+	ErrorCacheNotReady   = "cache_not_ready"
+	ErrorRequestTooLarge = "request_too_large"
+	ErrorOutOfScope      = "object_type_out_of_scope"
+	ErrorNotResolvable   = "userset_not_resolvable"
 )
 
 // CacheNotReady type
@@ -39,3 +43,51 @@ func NewCacheNotReady() *CacheNotReady {
 		),
 	}
 }
+
+// RequestTooLarge type
+type RequestTooLarge struct {
+	*service.GenericError
+}
+
+func NewRequestTooLarge(maxBytes int64) *RequestTooLarge {
+	return &RequestTooLarge{
+		GenericError: service.NewGenericError(
+			"RequestTooLarge",
+			ErrorRequestTooLarge,
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body must be at most %d bytes", maxBytes),
+		),
+	}
+}
+
+// ObjectTypeOutOfScope type
+type ObjectTypeOutOfScope struct {
+	*service.GenericError
+}
+
+func NewObjectTypeOutOfScope(objectType string) *ObjectTypeOutOfScope {
+	return &ObjectTypeOutOfScope{
+		GenericError: service.NewGenericError(
+			"ObjectTypeOutOfScope",
+			ErrorOutOfScope,
+			http.StatusBadRequest,
+			fmt.Sprintf("Warrants on object type %s are not synced to this edge agent", objectType),
+		),
+	}
+}
+
+// UsersetNotResolvable type
+type UsersetNotResolvable struct {
+	*service.GenericError
+}
+
+func NewUsersetNotResolvable(userset string) *UsersetNotResolvable {
+	return &UsersetNotResolvable{
+		GenericError: service.NewGenericError(
+			"UsersetNotResolvable",
+			ErrorNotResolvable,
+			http.StatusBadRequest,
+			fmt.Sprintf("Userset %s cannot be resolved by this edge agent", userset),
+		),
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/warrant-dev/edge/edgepb"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+	"github.com/warrant-dev/warrant/pkg/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcCheckServer serves the edgepb.CheckService using the same evaluation
+// code path as the HTTP check handlers.
+type grpcCheckServer struct {
+	edgepb.UnimplementedCheckServiceServer
+	server *Server
+}
+
+func (s *grpcCheckServer) Check(ctx context.Context, req *edgepb.CheckRequest) (*edgepb.CheckResult, error) {
+	if req.GetWarrant() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing required parameter: warrant")
+	}
+
+	checkManySpec := check.CheckManySpec{
+		Warrants: []check.CheckWarrantSpec{toCheckWarrantSpec(req.GetWarrant())},
+		Debug:    req.GetDebug(),
+	}
+
+	return s.checkMany(ctx, checkManySpec)
+}
+
+func (s *grpcCheckServer) CheckMany(ctx context.Context, req *edgepb.CheckManyRequest) (*edgepb.CheckResult, error) {
+	return s.checkMany(ctx, toCheckManySpec(req))
+}
+
+func (s *grpcCheckServer) BatchCheck(ctx context.Context, req *edgepb.BatchCheckRequest) (*edgepb.BatchCheckResponse, error) {
+	checkManySpecs := make([]check.CheckManySpec, len(req.GetChecks()))
+	for i, checkManyRequest := range req.GetChecks() {
+		checkManySpecs[i] = toCheckManySpec(checkManyRequest)
+	}
+
+	checkResults, err := s.server.batchCheckMany(ctx, checkManySpecs)
+	if err != nil {
+		return nil, toGrpcError(err)
+	}
+
+	results := make([]*edgepb.CheckResult, len(checkResults))
+	for i, checkResult := range checkResults {
+		results[i] = toCheckResult(checkResult.CheckResultSpec)
+	}
+
+	return &edgepb.BatchCheckResponse{
+		Results: results,
+	}, nil
+}
+
+func (s *grpcCheckServer) checkMany(ctx context.Context, checkManySpec check.CheckManySpec) (*edgepb.CheckResult, error) {
+	err := service.ValidateStruct(ctx, &checkManySpec)
+	if err != nil {
+		return nil, toGrpcError(err)
+	}
+
+	checkResult, _, err := s.server.checkMany(ctx, checkManySpec)
+	if err != nil {
+		return nil, toGrpcError(err)
+	}
+
+	return toCheckResult(checkResult.CheckResultSpec), nil
+}
+
+func newGrpcServer(server *Server, opts ...grpc.ServerOption) *grpc.Server {
+	if len(server.config.Tenants) > 0 {
+		opts = append(opts, grpc.UnaryInterceptor(grpcTenantInterceptor(server)))
+	} else if !server.config.DisableAuth {
+		opts = append(opts, grpc.UnaryInterceptor(grpcApiKeyAuthInterceptor(server.apiKeys)))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	edgepb.RegisterCheckServiceServer(grpcServer, &grpcCheckServer{
+		server: server,
+	})
+
+	return grpcServer
+}
+
+// grpcApiKeyAuthInterceptor rejects calls whose authorization metadata does
+// not contain one of the API keys returned by apiKeys.
+func grpcApiKeyAuthInterceptor(apiKeys func() []string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get("authorization")
+		if len(values) != 1 {
+			return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("Invalid authorization metadata: %s", ErrInvalidAuthorization))
+		}
+
+		apiKey, err := parseApiKey(values[0])
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("Invalid authorization metadata: %s", err))
+		}
+
+		if !containsApiKey(apiKeys(), apiKey) {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// grpcTenantInterceptor authenticates calls and routes them to their tenant.
+func grpcTenantInterceptor(server *Server) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		name := ""
+		if values := md.Get(strings.ToLower(HeaderTenant)); len(values) == 1 {
+			name = values[0]
+		}
+
+		apiKey := ""
+		if values := md.Get("authorization"); len(values) == 1 {
+			var err error
+			apiKey, err = parseApiKey(values[0])
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("Invalid authorization metadata: %s", err))
+			}
+		}
+
+		tenant, err := server.resolveTenant(name, apiKey)
+		if err != nil {
+			return nil, toGrpcError(err)
+		}
+
+		return handler(withTenant(ctx, tenant), req)
+	}
+}
+
+func toCheckManySpec(req *edgepb.CheckManyRequest) check.CheckManySpec {
+	var warrants []check.CheckWarrantSpec
+	for _, wnt := range req.GetWarrants() {
+		warrants = append(warrants, toCheckWarrantSpec(wnt))
+	}
+
+	return check.CheckManySpec{
+		Op:       req.GetOp(),
+		Warrants: warrants,
+		Context:  toPolicyContext(req.GetContext()),
+		Debug:    req.GetDebug(),
+	}
+}
+
+func toCheckWarrantSpec(wnt *edgepb.CheckWarrant) check.CheckWarrantSpec {
+	checkWarrantSpec := check.CheckWarrantSpec{
+		ObjectType: wnt.GetObjectType(),
+		ObjectId:   wnt.GetObjectId(),
+		Relation:   wnt.GetRelation(),
+		Context:    toPolicyContext(wnt.GetContext()),
+	}
+
+	if wnt.GetSubject() != nil {
+		checkWarrantSpec.Subject = &warrant.SubjectSpec{
+			ObjectType: wnt.GetSubject().GetObjectType(),
+			ObjectId:   wnt.GetSubject().GetObjectId(),
+			Relation:   wnt.GetSubject().GetRelation(),
+		}
+	}
+
+	return checkWarrantSpec
+}
+
+func toPolicyContext(context *structpb.Struct) warrant.PolicyContext {
+	if context == nil {
+		return nil
+	}
+
+	return warrant.PolicyContext(context.AsMap())
+}
+
+func toCheckResult(checkResult check.CheckResultSpec) *edgepb.CheckResult {
+	return &edgepb.CheckResult{
+		Code:           checkResult.Code,
+		Result:         checkResult.Result,
+		IsImplicit:     checkResult.IsImplicit,
+		ProcessingTime: checkResult.ProcessingTime,
+	}
+}
+
+// toGrpcError converts an error returned by the check code path into a gRPC
+// status error with the closest matching code.
+func toGrpcError(err error) error {
+	apiError, ok := err.(service.Error)
+	if !ok {
+		return status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	switch apiError.GetStatus() {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case http.StatusUnauthorized:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
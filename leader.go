@@ -0,0 +1,224 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultLeaseDuration = 15 * time.Second
+)
+
+var (
+	ErrMissingLeaderElectionRepository = errors.New("leader election requires a redis repository")
+	ErrLeaseLost                       = errors.New("leader lease lost")
+)
+
+// renewLeaseScript extends the lease only if it is still held by the caller.
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLeaseScript deletes the lease only if it is still held by the caller.
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type LeaderElectionConfig struct {
+	Id            string
+	LeaseDuration time.Duration
+	Repository    *RedisRepository
+}
+
+// LeaderElection uses a lease key in redis to ensure that only one of several
+// agents sharing a redis repository keeps it up to date at any given time.
+type LeaderElection struct {
+	config   LeaderElectionConfig
+	isLeader bool
+	lock     sync.RWMutex
+}
+
+func NewLeaderElection(conf LeaderElectionConfig) (*LeaderElection, error) {
+	config := LeaderElectionConfig{
+		Id:            conf.Id,
+		LeaseDuration: DefaultLeaseDuration,
+		Repository:    conf.Repository,
+	}
+
+	if conf.Repository == nil {
+		return nil, ErrMissingLeaderElectionRepository
+	}
+
+	if conf.LeaseDuration != 0 {
+		config.LeaseDuration = conf.LeaseDuration
+	}
+
+	if config.Id == "" {
+		id, err := newCandidateId()
+		if err != nil {
+			return nil, errors.Wrap(err, "error generating leader election id")
+		}
+		config.Id = id
+	}
+
+	// only let the repository be written while this agent holds the lease
+	config.Repository.leaseHolder = config.Id
+
+	return &LeaderElection{
+		config: config,
+	}, nil
+}
+
+// Run campaigns for leadership until ctx is cancelled, calling lead with a
+// context that is cancelled once leadership is lost.
+func (election *LeaderElection) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	var cancelLead context.CancelFunc
+	defer func() {
+		if cancelLead != nil {
+			cancelLead()
+		}
+		election.setLeader(false)
+		err := election.release()
+		if err != nil {
+			log.Println(errors.Wrap(err, "error releasing leader lease"))
+		}
+	}()
+
+	ticker := time.NewTicker(election.config.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		var err error
+		var acquired bool
+		if election.IsLeader() {
+			acquired, err = election.renew()
+		} else {
+			acquired, err = election.acquire()
+		}
+		if err != nil {
+			log.Println(errors.Wrap(err, "error during leader election"))
+			acquired = false
+		}
+
+		if acquired && !election.IsLeader() {
+			log.Printf("Elected leader (%s)", election.config.Id)
+			election.setLeader(true)
+
+			cancelLead = startLeading(ctx, lead)
+		} else if !acquired && election.IsLeader() {
+			log.Printf("Lost leadership (%s)", election.config.Id)
+			election.setLeader(false)
+			cancelLead()
+			cancelLead = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (election *LeaderElection) IsLeader() bool {
+	election.lock.RLock()
+	defer election.lock.RUnlock()
+
+	return election.isLeader
+}
+
+func (election *LeaderElection) setLeader(isLeader bool) {
+	election.lock.Lock()
+	defer election.lock.Unlock()
+
+	election.isLeader = isLeader
+}
+
+func (election *LeaderElection) acquire() (bool, error) {
+	acquired, err := election.config.Repository.client.SetNX(election.leaseKey(), election.config.Id, election.config.LeaseDuration).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "error acquiring leader lease in redis")
+	}
+
+	return acquired, nil
+}
+
+func (election *LeaderElection) renew() (bool, error) {
+	renewed, err := renewLeaseScript.Run(
+		election.config.Repository.client,
+		[]string{election.leaseKey()},
+		election.config.Id,
+		election.config.LeaseDuration.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return false, errors.Wrap(err, "error renewing leader lease in redis")
+	}
+
+	return renewed == 1, nil
+}
+
+func (election *LeaderElection) release() error {
+	err := releaseLeaseScript.Run(
+		election.config.Repository.client,
+		[]string{election.leaseKey()},
+		election.config.Id,
+	).Err()
+	if err != nil {
+		return errors.Wrap(err, "error releasing leader lease in redis")
+	}
+
+	return nil
+}
+
+func (election *LeaderElection) leaseKey() string {
+	return election.config.Repository.leaseKey()
+}
+
+func startLeading(ctx context.Context, lead func(ctx context.Context)) context.CancelFunc {
+	leadCtx, cancel := context.WithCancel(ctx)
+	go lead(leadCtx)
+	return cancel
+}
+
+func newCandidateId() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix)), nil
+}
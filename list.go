@@ -0,0 +1,235 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+	"github.com/warrant-dev/warrant/pkg/service"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+type ObjectSpec struct {
+	ObjectType string `json:"objectType"`
+	ObjectId   string `json:"objectId"`
+}
+
+// ListObjectsResultSpec is a page of the objects a subject has a relation on.
+// NextCursor is set if there are more objects to list.
+type ListObjectsResultSpec struct {
+	Results    []ObjectSpec `json:"results"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// ListSubjectsResultSpec is a page of the subjects with a relation on an
+// object. NextCursor is set if there are more subjects to list.
+type ListSubjectsResultSpec struct {
+	Results    []warrant.SubjectSpec `json:"results"`
+	NextCursor string                `json:"nextCursor,omitempty"`
+}
+
+// listObjects lists the objects a subject has a relation on directly, without
+// a policy, usersets or wildcards.
+func (server *Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !server.repository(r.Context()).Ready() {
+		service.SendErrorResponse(w, NewCacheNotReady())
+		return
+	}
+
+	query := r.URL.Query()
+	objectType, err := requiredParam(query, "objectType")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	if !server.config.ObjectTypes.Includes(objectType) {
+		service.SendErrorResponse(w, NewObjectTypeOutOfScope(objectType))
+		return
+	}
+
+	relation, err := requiredParam(query, "relation")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	subjectType, err := requiredParam(query, "subjectType")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	subjectId, err := requiredParam(query, "subjectId")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	subject := SubjectKey{
+		ObjectType: subjectType,
+		ObjectId:   subjectId,
+		Relation:   query.Get("subjectRelation"),
+	}
+
+	after, limit, err := pageParams(query)
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	// fetch one more than requested to know whether there is another page
+	objectIds, err := server.repository(r.Context()).ListObjects(objectType, relation, subject, after, limit+1)
+	if err != nil {
+		log.Println(errors.Wrap(err, "error listing objects"))
+		service.SendErrorResponse(w, service.NewInternalError("Error listing objects"))
+		return
+	}
+
+	result := ListObjectsResultSpec{
+		Results: make([]ObjectSpec, 0, len(objectIds)),
+	}
+	if len(objectIds) > limit {
+		objectIds = objectIds[:limit]
+		result.NextCursor = encodeCursor(objectIds[limit-1])
+	}
+
+	for _, objectId := range objectIds {
+		result.Results = append(result.Results, ObjectSpec{
+			ObjectType: objectType,
+			ObjectId:   objectId,
+		})
+	}
+
+	service.SendJSONResponse(w, result)
+}
+
+// listSubjects lists the subjects with a relation on an object directly,
+// without a policy or wildcards. Usersets are listed, not expanded.
+func (server *Server) listSubjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !server.repository(r.Context()).Ready() {
+		service.SendErrorResponse(w, NewCacheNotReady())
+		return
+	}
+
+	query := r.URL.Query()
+	objectType, err := requiredParam(query, "objectType")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	if !server.config.ObjectTypes.Includes(objectType) {
+		service.SendErrorResponse(w, NewObjectTypeOutOfScope(objectType))
+		return
+	}
+
+	objectId, err := requiredParam(query, "objectId")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	relation, err := requiredParam(query, "relation")
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	after, limit, err := pageParams(query)
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	subjects, err := server.repository(r.Context()).ListSubjects(objectType, objectId, relation, after, limit+1)
+	if err != nil {
+		log.Println(errors.Wrap(err, "error listing subjects"))
+		service.SendErrorResponse(w, service.NewInternalError("Error listing subjects"))
+		return
+	}
+
+	result := ListSubjectsResultSpec{
+		Results: make([]warrant.SubjectSpec, 0, len(subjects)),
+	}
+	if len(subjects) > limit {
+		subjects = subjects[:limit]
+		result.NextCursor = encodeCursor(subjects[limit-1].String())
+	}
+
+	for _, subject := range subjects {
+		result.Results = append(result.Results, *subject.Spec())
+	}
+
+	service.SendJSONResponse(w, result)
+}
+
+func requiredParam(query url.Values, name string) (string, error) {
+	value := query.Get(name)
+	if value == "" {
+		return "", service.NewMissingRequiredParameterError(name)
+	}
+
+	return value, nil
+}
+
+// pageParams parses the cursor and limit of a list request, returning the
+// value to list after and the number of results to return.
+func pageParams(query url.Values) (string, int, error) {
+	limit := DefaultListLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			return "", 0, service.NewInvalidParameterError("limit", fmt.Sprintf("must be a number between 1 and %d", MaxListLimit))
+		}
+	}
+
+	after := ""
+	if query.Has("nextCursor") {
+		cursor, err := base64.RawURLEncoding.DecodeString(query.Get("nextCursor"))
+		if err != nil || len(cursor) == 0 {
+			return "", 0, service.NewInvalidParameterError("nextCursor", "invalid cursor")
+		}
+		after = string(cursor)
+	}
+
+	return after, limit, nil
+}
+
+func encodeCursor(after string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(after))
+}
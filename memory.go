@@ -15,15 +15,34 @@
 package edge
 
 import (
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
 )
 
 type WarrantCache struct {
-	hashCount map[string]uint16
+	hashCount map[WarrantKey]uint16
+	usersets  map[string]map[SubjectKey]struct{}
+	policies  map[WarrantKey]map[warrant.Policy]struct{}
+	objects   map[string]*sortedIndex[string]
+	subjects  map[string]*sortedIndex[SubjectKey]
 	lock      sync.RWMutex
 }
 
-func (cache *WarrantCache) Contains(key string) bool {
+func newWarrantCache() *WarrantCache {
+	return &WarrantCache{
+		hashCount: make(map[WarrantKey]uint16),
+		usersets:  make(map[string]map[SubjectKey]struct{}),
+		policies:  make(map[WarrantKey]map[warrant.Policy]struct{}),
+		objects:   make(map[string]*sortedIndex[string]),
+		subjects:  make(map[string]*sortedIndex[SubjectKey]),
+	}
+}
+
+func (cache *WarrantCache) Contains(key WarrantKey) bool {
 	cache.lock.RLock()
 	defer cache.lock.RUnlock()
 
@@ -31,36 +50,130 @@ func (cache *WarrantCache) Contains(key string) bool {
 	return ok
 }
 
-func (cache *WarrantCache) Set(key string, count uint16) {
+func (cache *WarrantCache) ContainsMany(keys []WarrantKey) []bool {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	matches := make([]bool, len(keys))
+	for i, key := range keys {
+		_, matches[i] = cache.hashCount[key]
+	}
+
+	return matches
+}
+
+func (cache *WarrantCache) Usersets(objectRelations []string) [][]SubjectKey {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	usersets := make([][]SubjectKey, len(objectRelations))
+	for i, objectRelation := range objectRelations {
+		usersets[i] = make([]SubjectKey, 0, len(cache.usersets[objectRelation]))
+		for userset := range cache.usersets[objectRelation] {
+			usersets[i] = append(usersets[i], userset)
+		}
+	}
+
+	return usersets
+}
+
+func (cache *WarrantCache) Policies(keys []WarrantKey) [][]warrant.Policy {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	policies := make([][]warrant.Policy, len(keys))
+	for i, key := range keys {
+		policies[i] = make([]warrant.Policy, 0, len(cache.policies[key]))
+		for policy := range cache.policies[key] {
+			policies[i] = append(policies[i], policy)
+		}
+	}
+
+	return policies
+}
+
+// Objects returns a page of the ids of objects subject has relation on.
+func (cache *WarrantCache) Objects(objectType string, relation string, subject SubjectKey, after string, limit int) []string {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	index, ok := cache.objects[objectsIndexKey(objectType, relation, subject)]
+	if !ok {
+		return []string{}
+	}
+
+	return index.page(after, limit, func(objectId string) bool {
+		return objectId == warrant.Wildcard
+	})
+}
+
+// Subjects returns a page of the subjects with relation on an object.
+func (cache *WarrantCache) Subjects(objectType string, objectId string, relation string, after string, limit int) []SubjectKey {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	objectRelation := WarrantKey{ObjectType: objectType, ObjectId: objectId, Relation: relation}.ObjectRelation()
+	index, ok := cache.subjects[objectRelation]
+	if !ok {
+		return []SubjectKey{}
+	}
+
+	return index.page(after, limit, func(subject SubjectKey) bool {
+		return subject.ObjectId == warrant.Wildcard
+	})
+}
+
+// Range calls fn with a copy of every warrant, so fn doesn't hold up writers.
+func (cache *WarrantCache) Range(fn func(key WarrantKey, count uint16) error) error {
+	cache.lock.RLock()
+	warrants := make([]countedKey, 0, len(cache.hashCount))
+	for key, count := range cache.hashCount {
+		warrants = append(warrants, countedKey{key: key, count: count})
+	}
+	cache.lock.RUnlock()
+
+	for _, entry := range warrants {
+		err := fn(entry.key, entry.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type countedKey struct {
+	key   WarrantKey
+	count uint16
+}
+
+func (cache *WarrantCache) Set(key WarrantKey, count uint16) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
-	cache.hashCount[key] = count
+	cache.set(key, count)
 }
 
-func (cache *WarrantCache) Incr(key string) {
+func (cache *WarrantCache) Incr(key WarrantKey) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
-	if cache.Contains(key) {
-		cache.hashCount[key] = cache.hashCount[key] + 1
-		return
-	}
-
-	cache.hashCount[key] = 1
+	cache.set(key, cache.hashCount[key]+1)
 }
 
-func (cache *WarrantCache) Decr(key string) {
+func (cache *WarrantCache) Decr(key WarrantKey) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
-	if cache.Contains(key) {
-		count := cache.hashCount[key]
-		if count <= 1 {
-			delete(cache.hashCount, key)
-		} else {
-			cache.hashCount[key] = cache.hashCount[key] - 1
-		}
+	count, ok := cache.hashCount[key]
+	if !ok {
+		return
+	}
+
+	if count <= 1 {
+		cache.delete(key)
+	} else {
+		cache.hashCount[key] = count - 1
 	}
 }
 
@@ -70,57 +183,255 @@ func (cache *WarrantCache) Update(warrants WarrantSet) error {
 
 	// iterate over existing records and remove any that no longer exist
 	for key := range cache.hashCount {
-		if warrants.Has(key) {
-			cache.Set(key, warrants.Get(key))
-		} else {
-			delete(cache.hashCount, key)
+		if !warrants.Has(key) {
+			cache.delete(key)
 		}
 	}
 
-	// add any newly created records
+	// add or update the remaining records
 	for key, value := range warrants {
-		cache.Set(key, value)
+		cache.set(key, value)
 	}
 
 	return nil
 }
 
+// Add increments the count of each warrant by its count in warrants.
+func (cache *WarrantCache) Add(warrants WarrantSet) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key, count := range warrants {
+		cache.set(key, cache.hashCount[key]+count)
+	}
+}
+
+// Apply adds the counts of added and subtracts those of deleted.
+func (cache *WarrantCache) Apply(added WarrantSet, deleted WarrantSet) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key, count := range added {
+		cache.set(key, cache.hashCount[key]+count)
+	}
+
+	for key, count := range deleted {
+		current, ok := cache.hashCount[key]
+		if !ok {
+			continue
+		}
+
+		if current <= count {
+			cache.delete(key)
+		} else {
+			cache.hashCount[key] = current - count
+		}
+	}
+}
+
+// replace swaps the contents of the cache for those of other, which must not
+// be used afterwards.
+func (cache *WarrantCache) replace(other *WarrantCache) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.hashCount = other.hashCount
+	cache.usersets = other.usersets
+	cache.policies = other.policies
+	cache.objects = other.objects
+	cache.subjects = other.subjects
+}
+
 func (cache *WarrantCache) Clear() {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
-	cache.hashCount = make(map[string]uint16)
+
+	cache.hashCount = make(map[WarrantKey]uint16)
+	cache.usersets = make(map[string]map[SubjectKey]struct{})
+	cache.policies = make(map[WarrantKey]map[warrant.Policy]struct{})
+	cache.objects = make(map[string]*sortedIndex[string])
+	cache.subjects = make(map[string]*sortedIndex[SubjectKey])
+}
+
+// set and delete must be called with the lock held.
+func (cache *WarrantCache) set(key WarrantKey, count uint16) {
+	cache.hashCount[key] = count
+	if key.Policy != "" {
+		addToIndex(cache.policies, key.WithoutPolicy(), key.Policy)
+		return
+	}
+
+	if key.IsUserset() {
+		addToIndex(cache.usersets, key.ObjectRelation(), key.Subject)
+	}
+	addToSortedIndex(cache.objects, key.objectsIndexKey(), key.ObjectId, key.ObjectId)
+	addToSortedIndex(cache.subjects, key.ObjectRelation(), key.Subject.String(), key.Subject)
+}
+
+func (cache *WarrantCache) delete(key WarrantKey) {
+	delete(cache.hashCount, key)
+	if key.Policy != "" {
+		removeFromIndex(cache.policies, key.WithoutPolicy(), key.Policy)
+		return
+	}
+
+	if key.IsUserset() {
+		removeFromIndex(cache.usersets, key.ObjectRelation(), key.Subject)
+	}
+	removeFromSortedIndex(cache.objects, key.objectsIndexKey(), key.ObjectId)
+	removeFromSortedIndex(cache.subjects, key.ObjectRelation(), key.Subject.String())
+}
+
+func addToIndex[K comparable, V comparable](index map[K]map[V]struct{}, key K, value V) {
+	if _, exists := index[key]; !exists {
+		index[key] = make(map[V]struct{})
+	}
+	index[key][value] = struct{}{}
+}
+
+func removeFromIndex[K comparable, V comparable](index map[K]map[V]struct{}, key K, value V) {
+	delete(index[key], value)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// sortedIndex is a set of values kept in order of a string key once first
+// paged, so pages don't sort the whole set.
+type sortedIndex[V any] struct {
+	values map[string]V
+	keys   []string
+	sorted bool
+	lock   sync.Mutex
+}
+
+func addToSortedIndex[V any](indexes map[string]*sortedIndex[V], indexKey string, key string, value V) {
+	index, exists := indexes[indexKey]
+	if !exists {
+		index = &sortedIndex[V]{
+			values: make(map[string]V),
+		}
+		indexes[indexKey] = index
+	}
+
+	if _, exists := index.values[key]; exists {
+		return
+	}
+
+	index.values[key] = value
+	if index.sorted {
+		i := sort.SearchStrings(index.keys, key)
+		index.keys = append(index.keys, "")
+		copy(index.keys[i+1:], index.keys[i:])
+		index.keys[i] = key
+	}
+}
+
+func removeFromSortedIndex[V any](indexes map[string]*sortedIndex[V], indexKey string, key string) {
+	index, exists := indexes[indexKey]
+	if !exists {
+		return
+	}
+
+	if _, exists := index.values[key]; !exists {
+		return
+	}
+
+	delete(index.values, key)
+	if len(index.values) == 0 {
+		delete(indexes, indexKey)
+		return
+	}
+
+	if index.sorted {
+		i := sort.SearchStrings(index.keys, key)
+		index.keys = append(index.keys[:i], index.keys[i+1:]...)
+	}
+}
+
+// page returns up to limit values in order of their keys, starting after the
+// given key and leaving out values for which skip returns true.
+func (index *sortedIndex[V]) page(after string, limit int, skip func(V) bool) []V {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if !index.sorted {
+		index.keys = make([]string, 0, len(index.values))
+		for key := range index.values {
+			index.keys = append(index.keys, key)
+		}
+		sort.Strings(index.keys)
+		index.sorted = true
+	}
+
+	values := make([]V, 0, min(limit, len(index.keys)))
+	i := sort.Search(len(index.keys), func(i int) bool {
+		return index.keys[i] > after
+	})
+	for ; i < len(index.keys) && len(values) < limit; i++ {
+		value := index.values[index.keys[i]]
+		if !skip(value) {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
 
 type MemoryRepository struct {
-	cache *WarrantCache
-	lock  sync.RWMutex
-	ready bool
+	cache      *WarrantCache
+	lock       sync.RWMutex
+	ready      bool
+	lastSynced time.Time
+	version    uint64
 }
 
 func NewMemoryRepository() *MemoryRepository {
 	return &MemoryRepository{
-		cache: &WarrantCache{
-			hashCount: make(map[string]uint16),
-		},
+		cache: newWarrantCache(),
 		ready: true,
 	}
 }
 
-func (repo *MemoryRepository) Get(key string) (bool, error) {
+func (repo *MemoryRepository) Get(key WarrantKey) (bool, error) {
 	return repo.cache.Contains(key), nil
 }
 
-func (repo *MemoryRepository) Set(key string, count uint16) error {
+func (repo *MemoryRepository) GetMany(keys []WarrantKey) ([]bool, error) {
+	return repo.cache.ContainsMany(keys), nil
+}
+
+func (repo *MemoryRepository) GetUsersets(objectRelations []string) ([][]SubjectKey, error) {
+	return repo.cache.Usersets(objectRelations), nil
+}
+
+func (repo *MemoryRepository) GetPolicies(keys []WarrantKey) ([][]warrant.Policy, error) {
+	return repo.cache.Policies(keys), nil
+}
+
+func (repo *MemoryRepository) ListObjects(objectType string, relation string, subject SubjectKey, after string, limit int) ([]string, error) {
+	return repo.cache.Objects(objectType, relation, subject, after, limit), nil
+}
+
+func (repo *MemoryRepository) ListSubjects(objectType string, objectId string, relation string, after string, limit int) ([]SubjectKey, error) {
+	return repo.cache.Subjects(objectType, objectId, relation, after, limit), nil
+}
+
+func (repo *MemoryRepository) Range(fn func(key WarrantKey, count uint16) error) error {
+	return repo.cache.Range(fn)
+}
+
+func (repo *MemoryRepository) Set(key WarrantKey, count uint16) error {
 	repo.cache.Set(key, count)
 	return nil
 }
 
-func (repo *MemoryRepository) Incr(key string) error {
+func (repo *MemoryRepository) Incr(key WarrantKey) error {
 	repo.cache.Incr(key)
 	return nil
 }
 
-func (repo *MemoryRepository) Decr(key string) error {
+func (repo *MemoryRepository) Decr(key WarrantKey) error {
 	repo.cache.Decr(key)
 	return nil
 }
@@ -129,8 +440,30 @@ func (repo *MemoryRepository) Update(warrants WarrantSet) error {
 	return repo.cache.Update(warrants)
 }
 
+func (repo *MemoryRepository) ApplyDelta(delta Delta) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if repo.version != delta.BaseVersion {
+		return errors.Wrapf(ErrVersionConflict, "repository is at version %d, delta is from version %d", repo.version, delta.BaseVersion)
+	}
+
+	repo.cache.Apply(delta.Added, delta.Deleted)
+	repo.version = delta.Version
+	repo.lastSynced = delta.SyncedAt
+	return nil
+}
+
+// Load stages warrants in a separate cache that is swapped in on commit.
+func (repo *MemoryRepository) Load() (IRepositoryLoader, error) {
+	return &memoryLoader{
+		repo:    repo,
+		staging: newWarrantCache(),
+	}, nil
+}
+
 func (repo *MemoryRepository) Clear() error {
-	repo.cache.hashCount = make(map[string]uint16)
+	repo.cache.Clear()
 	return nil
 }
 
@@ -147,3 +480,66 @@ func (repo *MemoryRepository) Ready() bool {
 
 	return repo.ready
 }
+
+func (repo *MemoryRepository) SetLastSynced(lastSynced time.Time) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.lastSynced = lastSynced
+	return nil
+}
+
+func (repo *MemoryRepository) LastSynced() (time.Time, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	return repo.lastSynced, nil
+}
+
+func (repo *MemoryRepository) Version() (uint64, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	return repo.version, nil
+}
+
+func (repo *MemoryRepository) Datastore() string {
+	return DatastoreMemory
+}
+
+type memoryLoader struct {
+	repo    *MemoryRepository
+	staging *WarrantCache
+}
+
+func (loader *memoryLoader) Add(warrants WarrantSet) error {
+	loader.staging.Add(warrants)
+	return nil
+}
+
+func (loader *memoryLoader) Commit() error {
+	loader.repo.cache.replace(loader.staging)
+	loader.staging = newWarrantCache()
+	return nil
+}
+
+func (loader *memoryLoader) CommitVersion(baseVersion uint64, version uint64, syncedAt time.Time) error {
+	repo := loader.repo
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if repo.version != baseVersion {
+		return errors.Wrapf(ErrVersionConflict, "repository is at version %d, update is from version %d", repo.version, baseVersion)
+	}
+
+	repo.cache.replace(loader.staging)
+	loader.staging = newWarrantCache()
+	repo.version = version
+	repo.lastSynced = syncedAt
+	return nil
+}
+
+func (loader *memoryLoader) Discard() error {
+	loader.staging = newWarrantCache()
+	return nil
+}
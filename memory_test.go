@@ -0,0 +1,164 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
+func TestWarrantCacheObjects(t *testing.T) {
+	cache := newWarrantCache()
+	user := SubjectKey{ObjectType: "user", ObjectId: "1"}
+	for _, objectId := range []string{"3", "1", warrant.Wildcard, "2"} {
+		cache.Set(WarrantKey{ObjectType: "document", ObjectId: objectId, Relation: "viewer", Subject: user}, 1)
+	}
+
+	objects := func(after string, limit int) []string {
+		return cache.Objects("document", "viewer", user, after, limit)
+	}
+
+	expectPage(t, objects("", 2), []string{"1", "2"})
+	expectPage(t, objects("2", 2), []string{"3"})
+
+	// changes after the index is sorted keep it in order
+	cache.Set(WarrantKey{ObjectType: "document", ObjectId: "0", Relation: "viewer", Subject: user}, 1)
+	cache.Decr(WarrantKey{ObjectType: "document", ObjectId: "2", Relation: "viewer", Subject: user})
+	expectPage(t, objects("", 10), []string{"0", "1", "3"})
+	expectPage(t, objects("", 0), []string{})
+	expectPage(t, cache.Objects("document", "editor", user, "", 10), []string{})
+}
+
+func TestWarrantCacheSubjects(t *testing.T) {
+	cache := newWarrantCache()
+	subjects := []SubjectKey{
+		{ObjectType: "user", ObjectId: "2"},
+		{ObjectType: "group", ObjectId: "eng", Relation: "member"},
+		{ObjectType: "user", ObjectId: warrant.Wildcard},
+		{ObjectType: "user", ObjectId: "1"},
+	}
+	for _, subject := range subjects {
+		cache.Set(WarrantKey{ObjectType: "document", ObjectId: "1", Relation: "viewer", Subject: subject}, 1)
+	}
+
+	page := cache.Subjects("document", "1", "viewer", "", 10)
+	expectPage(t, subjectStrings(page), []string{"group:eng#member", "user:1", "user:2"})
+
+	page = cache.Subjects("document", "1", "viewer", "group:eng#member", 1)
+	expectPage(t, subjectStrings(page), []string{"user:1"})
+}
+
+func BenchmarkWarrantCacheObjects(b *testing.B) {
+	cache := newWarrantCache()
+	user := SubjectKey{ObjectType: "user", ObjectId: "1"}
+	for i := 0; i < 100000; i++ {
+		cache.Set(WarrantKey{ObjectType: "document", ObjectId: fmt.Sprintf("%d", i), Relation: "viewer", Subject: user}, 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Objects("document", "viewer", user, fmt.Sprintf("%d", i%100000), DefaultListLimit)
+	}
+}
+
+func subjectStrings(subjects []SubjectKey) []string {
+	strs := make([]string, len(subjects))
+	for i, subject := range subjects {
+		strs[i] = subject.String()
+	}
+
+	return strs
+}
+
+func expectPage(t *testing.T, actual []string, expected []string) {
+	t.Helper()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+// blockedWriter lets its first write through and blocks every later one until
+// released, like a client that stops reading a download.
+type blockedWriter struct {
+	bytes.Buffer
+	writes  int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == 2 {
+		close(w.blocked)
+	}
+	if w.writes > 1 {
+		<-w.release
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestExportSnapshotDoesNotBlockWriters(t *testing.T) {
+	repo := NewMemoryRepository()
+	warrants := make(WarrantSet)
+	for i := 0; i < 20000; i++ {
+		warrants[benchmarkKey(i)] = 1
+	}
+	err := repo.Update(warrants)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockedWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+	exported := make(chan error, 1)
+	go func() {
+		exported <- ExportSnapshot(w, repo)
+	}()
+	<-w.blocked
+
+	written := make(chan error, 1)
+	go func() {
+		written <- repo.Set(benchmarkKey(-1), 1)
+	}()
+
+	select {
+	case err = <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(w.release)
+		t.Fatal("expected write not to wait for the export")
+	}
+
+	close(w.release)
+	err = <-exported
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, _, err := DecodeWarrantSet(&w.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != len(warrants) {
+		t.Errorf("expected %d warrants in the snapshot, got %d", len(warrants), len(snapshot))
+	}
+}
@@ -15,13 +15,22 @@
 package edge
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warrant-dev/warrant/pkg/service"
 )
 
+const AuthTypeApiKey = "ApiKey"
+
+var ErrInvalidAuthorization = errors.New(fmt.Sprintf("must be of the form '%s <key>'", AuthTypeApiKey))
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -62,3 +71,44 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		)
 	})
 }
+
+// apiKeyAuthMiddleware rejects requests whose Authorization header does not
+// contain one of the API keys returned by apiKeys.
+func apiKeyAuthMiddleware(apiKeys func() []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, err := parseApiKey(r.Header.Get("Authorization"))
+		if err != nil {
+			service.SendErrorResponse(w, service.NewUnauthorizedError(fmt.Sprintf("Invalid authorization header: %s", err)))
+			return
+		}
+
+		if !containsApiKey(apiKeys(), apiKey) {
+			service.SendErrorResponse(w, service.NewUnauthorizedError("Invalid API key"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseApiKey returns the key from an authorization header or metadata value
+// of the form "ApiKey <key>".
+func parseApiKey(header string) (string, error) {
+	authType, apiKey, found := strings.Cut(header, " ")
+	if !found || authType != AuthTypeApiKey || apiKey == "" {
+		return "", ErrInvalidAuthorization
+	}
+
+	return apiKey, nil
+}
+
+// containsApiKey compares the given key against every valid key in constant
+// time so that response times do not reveal how much of a key matched.
+func containsApiKey(apiKeys []string, apiKey string) bool {
+	found := 0
+	for _, validApiKey := range apiKeys {
+		found |= subtle.ConstantTimeCompare([]byte(validApiKey), []byte(apiKey))
+	}
+
+	return found == 1
+}
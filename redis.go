@@ -15,29 +15,160 @@
 package edge
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/go-redis/redis"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
 )
 
+const (
+	DefaultRedisNamespace = "warrant"
+	RangeBatchSize        = 1000
+
+	InvalidationsPingInterval = 30 * time.Second
+
+	// KeyEncodingVersion is the version of the encoding of the keys in a
+	// namespace, recorded once keys in older encodings have been migrated.
+	KeyEncodingVersion = "2"
+
+	// GenerationRefreshInterval is how often the current generation is read.
+	GenerationRefreshInterval = time.Second
+
+	// GenerationRetention is how long replaced and idle generations are kept.
+	GenerationRetention = time.Minute
+)
+
+// transferOwner records ARGV[2] as the owner of the namespace whose owner key
+// is KEYS[1] if ARGV[1] owns it, or nobody does.
+var transferOwner = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] and owner ~= ARGV[2] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// renameKeyIfAbsent moves a warrant's count from KEYS[1] to KEYS[2] unless
+// KEYS[2] already holds it, such as when another agent migrated it first.
+var renameKeyIfAbsent = redis.NewScript(`
+local count = redis.call('GET', KEYS[1])
+if not count then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	redis.call('SET', KEYS[2], count)
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// switchGeneration makes ARGV[1] the current generation and returns the
+// previous one, if ARGV[3] holds the lease and the version is ARGV[4].
+var switchGeneration = redis.NewScript(`
+if ARGV[3] ~= '' and redis.call('GET', KEYS[3]) ~= ARGV[3] then
+	return false
+end
+if ARGV[4] ~= '' and (redis.call('GET', KEYS[4]) or '0') ~= ARGV[4] then
+	return redis.error_reply('` + versionConflictReply + `')
+end
+local previous = redis.call('GET', KEYS[1]) or '0'
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], previous)
+if ARGV[5] ~= '' then
+	redis.call('SET', KEYS[4], ARGV[5])
+	redis.call('SET', KEYS[5], ARGV[6])
+end
+return previous
+`)
+
+const versionConflictReply = "VERSION_CONFLICT"
+
+var ErrNamespaceOwnedByAnotherEnvironment = errors.New("redis namespace is already in use by a different environment")
+
 type RedisRepositoryConfig struct {
-	Hostname string
-	Password string
-	Port     string
-	Database int
+	Hostname             string
+	Password             string
+	Port                 string
+	Database             int
+	Namespace            string
+	ApiKey               string
+	PublishInvalidations bool
 }
 
+// RedisRepository stores warrants under a namespace in redis, in generations
+// that loads switch between at once.
 type RedisRepository struct {
-	client *redis.Client
-	ready  bool
-	lock   sync.Mutex
+	client               *redis.Client
+	namespace            string
+	publishInvalidations bool
+	ready                bool
+	generation           uint64
+	generationCheckedAt  time.Time
+	generationLock       sync.Mutex
+	pinned               bool
+	leaseHolder          string
+	lock                 sync.Mutex
 }
 
+// NewRedisRepository connects to redis and claims the namespace for the API
+// key's environment.
 func NewRedisRepository(config RedisRepositoryConfig) (*RedisRepository, error) {
+	repo, err := connectRedisRepository(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ApiKey != "" {
+		err = repo.claimNamespace(ApiKeyFingerprint(config.ApiKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = repo.migrateKeyEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// OpenRedisRepository connects to redis to inspect a namespace without
+// claiming it.
+func OpenRedisRepository(config RedisRepositoryConfig) (*RedisRepository, error) {
+	repo, err := connectRedisRepository(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ApiKey != "" {
+		owner, err := repo.client.Get(repo.ownerKey()).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrap(err, "error getting namespace owner from redis")
+		}
+
+		if err == nil && owner != ApiKeyFingerprint(config.ApiKey) {
+			return nil, errors.Wrapf(ErrNamespaceOwnedByAnotherEnvironment, "namespace %s", repo.getNamespace())
+		}
+	}
+
+	return repo, nil
+}
+
+func connectRedisRepository(config RedisRepositoryConfig) (*RedisRepository, error) {
 	hostname := config.Hostname
 	if config.Hostname == "" {
 		hostname = "127.0.0.1"
@@ -66,13 +197,27 @@ func NewRedisRepository(config RedisRepositoryConfig) (*RedisRepository, error)
 		return nil, errors.Wrap(err, "Unable to ping redis. Check your credentials.")
 	}
 
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = DefaultRedisNamespace
+	}
+
 	return &RedisRepository{
-		client: rdb,
-		ready:  true,
+		client:               rdb,
+		namespace:            namespace,
+		publishInvalidations: config.PublishInvalidations,
+		ready:                true,
 	}, nil
 }
 
-func (repo *RedisRepository) Get(key string) (bool, error) {
+// ApiKeyFingerprint returns a stable, non-reversible identifier for the
+// environment an API key belongs to.
+func ApiKeyFingerprint(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func (repo *RedisRepository) Get(key WarrantKey) (bool, error) {
 	_, err := repo.client.Get(repo.keyWithNamespace(key)).Result()
 	if err == redis.Nil {
 		return false, nil
@@ -84,45 +229,294 @@ func (repo *RedisRepository) Get(key string) (bool, error) {
 	return true, nil
 }
 
-func (repo *RedisRepository) Set(key string, count uint16) error {
-	_, err := repo.client.Set(repo.keyWithNamespace(key), count, 0).Result()
+func (repo *RedisRepository) GetMany(keys []WarrantKey) ([]bool, error) {
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+
+	namespacedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		namespacedKeys[i] = repo.keyWithNamespace(key)
+	}
+
+	values, err := repo.client.MGet(namespacedKeys...).Result()
 	if err != nil {
-		return errors.Wrap(err, "error setting key in redis")
+		return nil, errors.Wrap(err, "error getting keys from redis")
+	}
+
+	matches := make([]bool, len(keys))
+	for i, value := range values {
+		matches[i] = value != nil
+	}
+
+	return matches, nil
+}
+
+func (repo *RedisRepository) GetUsersets(objectRelations []string) ([][]SubjectKey, error) {
+	setKeys := make([]string, len(objectRelations))
+	for i, objectRelation := range objectRelations {
+		setKeys[i] = repo.usersetsKey(objectRelation)
+	}
+
+	members, err := repo.getMembers(setKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting usersets from redis")
+	}
+
+	usersets := make([][]SubjectKey, len(members))
+	for i := range members {
+		usersets[i], err = parseSubjectKeys(members[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid userset in redis")
+		}
+	}
+
+	return usersets, nil
+}
+
+func (repo *RedisRepository) GetPolicies(keys []WarrantKey) ([][]warrant.Policy, error) {
+	setKeys := make([]string, len(keys))
+	for i, key := range keys {
+		setKeys[i] = repo.policiesKey(key)
+	}
+
+	members, err := repo.getMembers(setKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting policies from redis")
+	}
+
+	policies := make([][]warrant.Policy, len(members))
+	for i := range members {
+		policies[i] = make([]warrant.Policy, len(members[i]))
+		for j, policy := range members[i] {
+			policies[i][j] = warrant.Policy(policy)
+		}
+	}
+
+	return policies, nil
+}
+
+// getMembers returns the members of each of the given sets in a single round
+// trip.
+func (repo *RedisRepository) getMembers(setKeys []string) ([][]string, error) {
+	if len(setKeys) == 0 {
+		return [][]string{}, nil
+	}
+
+	pipe := repo.client.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.StringSliceCmd, len(setKeys))
+	for i, setKey := range setKeys {
+		cmds[i] = pipe.SMembers(setKey)
+	}
+
+	_, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([][]string, len(setKeys))
+	for i, cmd := range cmds {
+		members[i] = cmd.Val()
+	}
+
+	return members, nil
+}
+
+func (repo *RedisRepository) ListObjects(objectType string, relation string, subject SubjectKey, after string, limit int) ([]string, error) {
+	objectIds, err := repo.pageIndex(repo.objectsKey(objectsIndexKey(objectType, relation, subject)), after, limit, func(objectId string) bool {
+		return objectId == warrant.Wildcard
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing objects from redis")
+	}
+
+	return objectIds, nil
+}
+
+func (repo *RedisRepository) ListSubjects(objectType string, objectId string, relation string, after string, limit int) ([]SubjectKey, error) {
+	objectRelation := WarrantKey{ObjectType: objectType, ObjectId: objectId, Relation: relation}.ObjectRelation()
+	members, err := repo.pageIndex(repo.subjectsKey(objectRelation), after, limit, func(member string) bool {
+		subject, err := ParseSubjectKey(member)
+		return err == nil && subject.ObjectId == warrant.Wildcard
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing subjects from redis")
+	}
+
+	subjects, err := parseSubjectKeys(members)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid subject in redis")
+	}
+
+	return subjects, nil
+}
+
+// pageIndex returns up to limit members of an index after the given member.
+func (repo *RedisRepository) pageIndex(setKey string, after string, limit int, skip func(member string) bool) ([]string, error) {
+	members := make([]string, 0, limit)
+	for len(members) < limit {
+		min := "-"
+		if after != "" {
+			min = fmt.Sprintf("(%s", after)
+		}
+
+		count := limit - len(members)
+		page, err := repo.client.ZRangeByLex(setKey, redis.ZRangeBy{
+			Min:   min,
+			Max:   "+",
+			Count: int64(count),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range page {
+			if !skip(member) {
+				members = append(members, member)
+			}
+		}
+
+		if len(page) < count {
+			break
+		}
+		after = page[len(page)-1]
+	}
+
+	return members, nil
+}
+
+// Range calls fn with every warrant in the repository, fetching their counts
+// in batches of up to RangeBatchSize.
+func (repo *RedisRepository) Range(fn func(key WarrantKey, count uint16) error) error {
+	current := repo.generationRepository(repo.currentGeneration())
+	return current.scanBatches(fmt.Sprintf("%s:*", current.dataNamespace()), func(keysWithNamespace []string) error {
+		return current.rangeBatch(keysWithNamespace, fn)
+	})
+}
+
+// scanBatches calls fn with the keys matching pattern in batches of up to
+// RangeBatchSize.
+func (repo *RedisRepository) scanBatches(pattern string, fn func(keys []string) error) error {
+	iter := repo.client.Scan(0, pattern, RangeBatchSize).Iterator()
+	batch := make([]string, 0, RangeBatchSize)
+	for {
+		hasNext := iter.Next()
+		if hasNext {
+			batch = append(batch, iter.Val())
+		}
+
+		if len(batch) == RangeBatchSize || (!hasNext && len(batch) > 0) {
+			err := fn(batch)
+			if err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+
+		if !hasNext {
+			break
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errors.Wrap(err, "error iterating over keys in redis")
 	}
 
 	return nil
 }
 
-func (repo *RedisRepository) Incr(key string) error {
-	_, err := repo.client.Incr(repo.keyWithNamespace(key)).Result()
+func (repo *RedisRepository) rangeBatch(keysWithNamespace []string, fn func(key WarrantKey, count uint16) error) error {
+	values, err := repo.client.MGet(keysWithNamespace...).Result()
 	if err != nil {
-		return errors.Wrap(err, "error incrementing key in redis")
+		return errors.Wrap(err, "error getting keys from redis")
+	}
+
+	for i, value := range values {
+		// skip keys removed since the scan and any we cannot have written
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		key, err := repo.keyWithoutNamespace(keysWithNamespace[i])
+		if err != nil {
+			continue
+		}
+
+		count, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			continue
+		}
+
+		err = fn(key, uint16(count))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (repo *RedisRepository) Decr(key string) error {
+func (repo *RedisRepository) Set(key WarrantKey, count uint16) error {
+	namespacedKey := repo.keyWithNamespace(key)
+	err := repo.fenced(func(pipe redis.Pipeliner) {
+		pipe.Set(namespacedKey, count, 0)
+		repo.addToIndexes(pipe, key)
+	})
+	if err != nil {
+		return errors.Wrap(err, "error setting key in redis")
+	}
+
+	return repo.publishInvalidation(key.String())
+}
+
+func (repo *RedisRepository) Incr(key WarrantKey) error {
+	namespacedKey := repo.keyWithNamespace(key)
+	err := repo.fenced(func(pipe redis.Pipeliner) {
+		pipe.Incr(namespacedKey)
+		repo.addToIndexes(pipe, key)
+	})
+	if err != nil {
+		return errors.Wrap(err, "error incrementing key in redis")
+	}
+
+	return repo.publishInvalidation(key.String())
+}
+
+func (repo *RedisRepository) Decr(key WarrantKey) error {
 	namespacedKey := repo.keyWithNamespace(key)
 	maxRetries := 10
 	decrementAndRemoveFunc := func(tx *redis.Tx) error {
-		count, err := repo.client.Decr(namespacedKey).Result()
+		err := repo.checkLease(tx)
 		if err != nil {
-			return errors.Wrap(err, "error decrementing key in redis")
+			return err
 		}
 
-		if count <= 0 {
-			_, err = repo.client.Del(namespacedKey).Result()
-			if err != nil {
-				return errors.Wrap(err, "error deleting key from redis")
+		count, err := tx.Get(namespacedKey).Int64()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(err, "error getting key from redis")
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			if count <= 1 {
+				pipe.Del(namespacedKey)
+				repo.removeFromIndexes(pipe, key)
+			} else {
+				pipe.Decr(namespacedKey)
 			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "error decrementing key in redis")
 		}
 
 		return nil
 	}
 
 	for i := 0; i < maxRetries; i++ {
-		err := repo.client.Watch(decrementAndRemoveFunc, namespacedKey)
+		err := repo.client.Watch(decrementAndRemoveFunc, repo.withLeaseKey(namespacedKey)...)
 		if err == redis.TxFailedErr {
 			// Retry
 			continue
@@ -130,22 +524,41 @@ func (repo *RedisRepository) Decr(key string) error {
 			return errors.Wrap(err, "error calling watch in redis")
 		}
 
-		return nil
+		return repo.publishInvalidation(key.String())
 	}
 
 	return errors.New(fmt.Sprintf("unable to acquire lock to remove %s from cache", key))
 }
 
 func (repo *RedisRepository) Update(warrants WarrantSet) error {
-	prefix := fmt.Sprintf("%s*", repo.getNamespace())
+	err := repo.refreshGeneration()
+	if err != nil {
+		return err
+	}
+
+	return repo.generationRepository(repo.currentGeneration()).update(warrants)
+}
+
+func (repo *RedisRepository) update(warrants WarrantSet) error {
+	prefix := fmt.Sprintf("%s:*", repo.dataNamespace())
 	iter := repo.client.Scan(0, prefix, 0).Iterator()
 
 	// iterate over existing records and remove any that no longer exist
 	for iter.Next() {
 		keyWithNamespace := iter.Val()
-		keyWithoutNamespace := repo.keyWithoutNamespace(keyWithNamespace)
+		keyWithoutNamespace, err := repo.keyWithoutNamespace(keyWithNamespace)
+		if err != nil {
+			// not a key we can have written, so it cannot be a current warrant
+			err = repo.client.Del(keyWithNamespace).Err()
+			if err != nil {
+				return errors.Wrap(err, "error deleting key from redis")
+			}
+
+			continue
+		}
+
 		if warrants.Has(keyWithoutNamespace) {
-			err := repo.Set(keyWithoutNamespace, warrants.Get(keyWithoutNamespace))
+			err := repo.set(keyWithoutNamespace, warrants.Get(keyWithoutNamespace))
 			if err != nil {
 				return errors.Wrap(err, "error updating key in redis")
 			}
@@ -154,6 +567,11 @@ func (repo *RedisRepository) Update(warrants WarrantSet) error {
 			if err != nil {
 				return errors.Wrap(err, "error deleting key from redis")
 			}
+
+			err = repo.unindexKey(keyWithoutNamespace)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	if err := iter.Err(); err != nil {
@@ -162,31 +580,157 @@ func (repo *RedisRepository) Update(warrants WarrantSet) error {
 
 	// add any newly created records
 	for keyWithoutNamespace, count := range warrants {
-		err := repo.Set(keyWithoutNamespace, count)
+		err := repo.set(keyWithoutNamespace, count)
 		if err != nil {
 			return errors.Wrap(err, "error updating key in redis")
 		}
 	}
 
-	return nil
+	return repo.publishInvalidation(InvalidateAllKeys)
 }
 
-func (repo *RedisRepository) Clear() error {
-	prefix := fmt.Sprintf("%s*", repo.getNamespace())
-	iter := repo.client.Scan(0, prefix, 0).Iterator()
+// ApplyDelta applies a delta in a transaction watching the version and the
+// delta's warrants.
+func (repo *RedisRepository) ApplyDelta(delta Delta) error {
+	changes := make(map[WarrantKey]int64, len(delta.Added)+len(delta.Deleted))
+	for key, count := range delta.Added {
+		changes[key] += int64(count)
+	}
+	for key, count := range delta.Deleted {
+		changes[key] -= int64(count)
+	}
 
-	for iter.Next() {
-		key := iter.Val()
-		err := repo.client.Del(key).Err()
+	keys := make([]WarrantKey, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+
+	// the transaction is retried if the current generation is switched before
+	// it commits, so that it never writes to a replaced generation
+	var current *RedisRepository
+	keysWithNamespace := make([]string, len(keys))
+	apply := func(tx *redis.Tx) error {
+		err := repo.checkLease(tx)
+		if err != nil {
+			return err
+		}
+
+		generation, err := tx.Get(repo.generationKey()).Uint64()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(err, "error getting generation from redis")
+		}
+
+		if generation != current.generation {
+			return redis.TxFailedErr
+		}
+
+		version, err := tx.Get(repo.versionKey()).Uint64()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(err, "error getting version from redis")
+		}
+
+		if version != delta.BaseVersion {
+			return errors.Wrapf(ErrVersionConflict, "repository is at version %d, delta is from version %d", version, delta.BaseVersion)
+		}
+
+		counts := make([]interface{}, len(keys))
+		if len(keys) > 0 {
+			counts, err = tx.MGet(keysWithNamespace...).Result()
+			if err != nil {
+				return errors.Wrap(err, "error getting keys from redis")
+			}
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				var currentCount int64
+				if str, ok := counts[i].(string); ok {
+					currentCount, _ = strconv.ParseInt(str, 10, 64)
+				}
+
+				count := currentCount + changes[key]
+				if count > 0 {
+					pipe.Set(keysWithNamespace[i], count, 0)
+					current.addToIndexes(pipe, key)
+				} else if currentCount > 0 {
+					pipe.Del(keysWithNamespace[i])
+					current.removeFromIndexes(pipe, key)
+				}
+			}
+
+			pipe.Set(repo.versionKey(), delta.Version, 0)
+			pipe.Set(repo.lastSyncedKey(), delta.SyncedAt.Format(time.RFC3339Nano), 0)
+			return nil
+		})
 		if err != nil {
-			return errors.Wrap(err, "error deleting key from redis")
+			return errors.Wrap(err, "error applying delta in redis")
 		}
+
+		return nil
 	}
-	if err := iter.Err(); err != nil {
-		return errors.Wrap(err, "error iterating over keys in redis")
+
+	maxRetries := 10
+	for i := 0; i < maxRetries; i++ {
+		err := repo.refreshGeneration()
+		if err != nil {
+			return err
+		}
+
+		current = repo.generationRepository(repo.currentGeneration())
+		for j, key := range keys {
+			keysWithNamespace[j] = current.keyWithNamespace(key)
+		}
+
+		err = repo.client.Watch(apply, repo.withLeaseKey(append([]string{repo.versionKey(), repo.generationKey()}, keysWithNamespace...)...)...)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return repo.publishInvalidation(InvalidateAllKeys)
 	}
 
-	return nil
+	return errors.Errorf("unable to apply delta to version %d after %d attempts", delta.Version, maxRetries)
+}
+
+// Load stages warrants in a new generation that becomes current on commit.
+func (repo *RedisRepository) Load() (IRepositoryLoader, error) {
+	err := repo.removeRetiredGenerations()
+	if err != nil {
+		return nil, err
+	}
+
+	generation, err := repo.client.Incr(repo.nextGenerationKey()).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating generation in redis")
+	}
+
+	loader := &redisLoader{
+		repo:    repo,
+		staging: repo.generationRepository(uint64(generation)),
+	}
+	err = loader.keepAlive(repo.client)
+	if err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+func (repo *RedisRepository) Clear() error {
+	err := repo.refreshGeneration()
+	if err != nil {
+		return err
+	}
+
+	err = repo.generationRepository(repo.currentGeneration()).deleteGeneration()
+	if err != nil {
+		return err
+	}
+
+	return repo.publishInvalidation(InvalidateAllKeys)
 }
 
 func (repo *RedisRepository) SetReady(newReady bool) {
@@ -203,14 +747,694 @@ func (repo *RedisRepository) Ready() bool {
 	return repo.ready
 }
 
-func (repo *RedisRepository) getNamespace() string {
-	return "warrant"
+// SetLastSynced records when the repository was last brought up to date. It
+// is stored in redis so that every agent sharing the namespace can report it.
+func (repo *RedisRepository) SetLastSynced(lastSynced time.Time) error {
+	err := repo.client.Set(repo.lastSyncedKey(), lastSynced.Format(time.RFC3339Nano), 0).Err()
+	if err != nil {
+		return errors.Wrap(err, "error setting last synced time in redis")
+	}
+
+	return nil
 }
 
-func (repo *RedisRepository) keyWithNamespace(key string) string {
-	return fmt.Sprintf("%s:%s", repo.getNamespace(), key)
+func (repo *RedisRepository) LastSynced() (time.Time, error) {
+	value, err := repo.client.Get(repo.lastSyncedKey()).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "error getting last synced time from redis")
+	}
+
+	lastSynced, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "invalid last synced time in redis")
+	}
+
+	return lastSynced, nil
 }
 
-func (repo *RedisRepository) keyWithoutNamespace(key string) string {
-	return strings.TrimPrefix(key, fmt.Sprintf("%s:", repo.getNamespace()))
+func (repo *RedisRepository) Version() (uint64, error) {
+	version, err := repo.client.Get(repo.versionKey()).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting version from redis")
+	}
+
+	return version, nil
+}
+
+func (repo *RedisRepository) Datastore() string {
+	return DatastoreRedis
+}
+
+// SubscribeInvalidations calls handler with each key other writers invalidate
+// until ctx is cancelled.
+func (repo *RedisRepository) SubscribeInvalidations(ctx context.Context, handler func(key string)) error {
+	pubsub := repo.client.Subscribe(repo.invalidationChannel())
+	defer pubsub.Close()
+
+	for ctx.Err() == nil {
+		msg, err := pubsub.ReceiveTimeout(InvalidationsPingInterval)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// a broken connection fails the next receive
+			_ = pubsub.Ping()
+			continue
+		}
+		if err != nil {
+			// the next receive reconnects and resubscribes, but anything
+			// published in the meantime is lost
+			log.Println(errors.Wrap(err, "error receiving invalidations from redis"))
+			repo.refreshGenerationOrLog()
+			handler(InvalidateAllKeys)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// anything may have changed while we weren't subscribed
+			repo.refreshGenerationOrLog()
+			handler(InvalidateAllKeys)
+		case *redis.Message:
+			// a load may have switched generations, which readers must
+			// pick up before reading through again
+			if msg.Payload == InvalidateAllKeys {
+				repo.refreshGenerationOrLog()
+			}
+			handler(msg.Payload)
+		}
+	}
+
+	return nil
+}
+
+func (repo *RedisRepository) set(key WarrantKey, count uint16) error {
+	_, err := repo.client.Set(repo.keyWithNamespace(key), count, 0).Result()
+	if err != nil {
+		return errors.Wrap(err, "error setting key in redis")
+	}
+
+	return repo.indexKey(key)
+}
+
+// indexKey records the warrant in the indexes used to find warrants without
+// knowing their full key, such as by userset or policy, and to list them.
+func (repo *RedisRepository) indexKey(key WarrantKey) error {
+	pipe := repo.client.TxPipeline()
+	defer pipe.Close()
+
+	repo.addToIndexes(pipe, key)
+	_, err := pipe.Exec()
+	if err != nil {
+		return errors.Wrap(err, "error indexing warrant in redis")
+	}
+
+	return nil
+}
+
+func (repo *RedisRepository) unindexKey(key WarrantKey) error {
+	pipe := repo.client.TxPipeline()
+	defer pipe.Close()
+
+	repo.removeFromIndexes(pipe, key)
+	_, err := pipe.Exec()
+	if err != nil {
+		return errors.Wrap(err, "error removing warrant index from redis")
+	}
+
+	return nil
+}
+
+func (repo *RedisRepository) addToIndexes(pipe redis.Pipeliner, key WarrantKey) {
+	if key.Policy != "" {
+		pipe.SAdd(repo.policiesKey(key.WithoutPolicy()), string(key.Policy))
+		return
+	}
+
+	if key.IsUserset() {
+		pipe.SAdd(repo.usersetsKey(key.ObjectRelation()), key.Subject.String())
+	}
+	pipe.ZAdd(repo.objectsKey(key.objectsIndexKey()), redis.Z{Member: key.ObjectId})
+	pipe.ZAdd(repo.subjectsKey(key.ObjectRelation()), redis.Z{Member: key.Subject.String()})
+}
+
+func (repo *RedisRepository) removeFromIndexes(pipe redis.Pipeliner, key WarrantKey) {
+	if key.Policy != "" {
+		pipe.SRem(repo.policiesKey(key.WithoutPolicy()), string(key.Policy))
+		return
+	}
+
+	if key.IsUserset() {
+		pipe.SRem(repo.usersetsKey(key.ObjectRelation()), key.Subject.String())
+	}
+	pipe.ZRem(repo.objectsKey(key.objectsIndexKey()), key.ObjectId)
+	pipe.ZRem(repo.subjectsKey(key.ObjectRelation()), key.Subject.String())
+}
+
+func (repo *RedisRepository) publishInvalidation(key string) error {
+	if !repo.publishInvalidations {
+		return nil
+	}
+
+	err := repo.client.Publish(repo.invalidationChannel(), key).Err()
+	if err != nil {
+		return errors.Wrap(err, "error publishing invalidation to redis")
+	}
+
+	return nil
+}
+
+// fenced runs the writes added by fn in a transaction that, if the repository
+// is written by a leader, only commits while the leader still holds its lease.
+func (repo *RedisRepository) fenced(fn func(pipe redis.Pipeliner)) error {
+	if repo.leaseHolder == "" {
+		pipe := repo.client.TxPipeline()
+		defer pipe.Close()
+
+		fn(pipe)
+		_, err := pipe.Exec()
+		return err
+	}
+
+	write := func(tx *redis.Tx) error {
+		err := repo.checkLease(tx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			fn(pipe)
+			return nil
+		})
+		return err
+	}
+
+	maxRetries := 10
+	for i := 0; i < maxRetries; i++ {
+		err := repo.client.Watch(write, repo.leaseKey())
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+
+	return errors.Errorf("unable to write to redis after %d attempts", maxRetries)
+}
+
+// checkLease fails with ErrLeaseLost if the repository is written by a leader
+// that no longer holds its lease.
+func (repo *RedisRepository) checkLease(tx *redis.Tx) error {
+	if repo.leaseHolder == "" {
+		return nil
+	}
+
+	holder, err := tx.Get(repo.leaseKey()).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "error getting leader lease from redis")
+	}
+
+	if holder != repo.leaseHolder {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (repo *RedisRepository) withLeaseKey(keys ...string) []string {
+	if repo.leaseHolder == "" {
+		return keys
+	}
+
+	return append(keys, repo.leaseKey())
+}
+
+// currentGeneration returns the generation the repository reads and writes.
+func (repo *RedisRepository) currentGeneration() uint64 {
+	repo.generationLock.Lock()
+	defer repo.generationLock.Unlock()
+
+	if repo.pinned || time.Since(repo.generationCheckedAt) < GenerationRefreshInterval {
+		return repo.generation
+	}
+
+	// keep using the last known generation until redis can be reached
+	generation, err := repo.getGeneration()
+	if err != nil {
+		log.Println(err)
+	} else {
+		repo.generation = generation
+	}
+	repo.generationCheckedAt = time.Now()
+
+	return repo.generation
+}
+
+// refreshGeneration checks which generation of warrants is current.
+func (repo *RedisRepository) refreshGeneration() error {
+	if repo.pinned {
+		return nil
+	}
+
+	generation, err := repo.getGeneration()
+	if err != nil {
+		return err
+	}
+
+	repo.setGeneration(generation)
+	return nil
+}
+
+func (repo *RedisRepository) refreshGenerationOrLog() {
+	err := repo.refreshGeneration()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (repo *RedisRepository) setGeneration(generation uint64) {
+	repo.generationLock.Lock()
+	defer repo.generationLock.Unlock()
+
+	repo.generation = generation
+	repo.generationCheckedAt = time.Now()
+}
+
+func (repo *RedisRepository) getGeneration() (uint64, error) {
+	generation, err := repo.client.Get(repo.generationKey()).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting generation from redis")
+	}
+
+	return generation, nil
+}
+
+// generationRepository returns a repository reading and writing the given
+// generation of warrants in the namespace, whichever generation is current.
+func (repo *RedisRepository) generationRepository(generation uint64) *RedisRepository {
+	return &RedisRepository{
+		client:               repo.client,
+		namespace:            repo.namespace,
+		publishInvalidations: repo.publishInvalidations,
+		ready:                true,
+		generation:           generation,
+		pinned:               true,
+	}
+}
+
+// deleteGeneration deletes the warrants and indexes of the repository's
+// generation in batches of up to RangeBatchSize keys.
+func (repo *RedisRepository) deleteGeneration() error {
+	// every key of a later generation is prefixed by its namespace, while the
+	// first generation shares its prefix with the namespace's own keys
+	patterns := []string{fmt.Sprintf("%s[:.]*", repo.dataNamespace())}
+	if repo.currentGeneration() == 0 {
+		patterns = []string{
+			fmt.Sprintf("%s:*", repo.dataNamespace()),
+			fmt.Sprintf("%s:*", repo.usersetsPrefix()),
+			fmt.Sprintf("%s:*", repo.policiesPrefix()),
+			fmt.Sprintf("%s:*", repo.objectsPrefix()),
+			fmt.Sprintf("%s:*", repo.subjectsPrefix()),
+		}
+	}
+	for _, pattern := range patterns {
+		err := repo.scanBatches(pattern, func(keys []string) error {
+			err := repo.client.Del(keys...).Err()
+			if err != nil {
+				return errors.Wrap(err, "error deleting keys from redis")
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeRetiredGenerations deletes replaced and abandoned generations.
+func (repo *RedisRepository) removeRetiredGenerations() error {
+	err := repo.refreshGeneration()
+	if err != nil {
+		return err
+	}
+
+	retired, err := repo.client.ZRangeByScore(repo.generationsKey(), redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-GenerationRetention).Unix(), 10),
+	}).Result()
+	if err != nil {
+		return errors.Wrap(err, "error getting retired generations from redis")
+	}
+
+	current := repo.currentGeneration()
+	for _, member := range retired {
+		generation, err := strconv.ParseUint(member, 10, 64)
+		if err == nil && generation != current {
+			err = repo.generationRepository(generation).deleteGeneration()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = repo.client.ZRem(repo.generationsKey(), member).Err()
+		if err != nil {
+			return errors.Wrap(err, "error removing generation from redis")
+		}
+	}
+
+	return nil
+}
+
+// claimNamespace records the given environment fingerprint as the owner of
+// the repository's namespace, failing if a different environment owns it.
+func (repo *RedisRepository) claimNamespace(fingerprint string) error {
+	ownerKey := repo.ownerKey()
+	_, err := repo.client.SetNX(ownerKey, fingerprint, 0).Result()
+	if err != nil {
+		return errors.Wrap(err, "error claiming namespace in redis")
+	}
+
+	owner, err := repo.client.Get(ownerKey).Result()
+	if err != nil {
+		return errors.Wrap(err, "error getting namespace owner from redis")
+	}
+
+	if owner != fingerprint {
+		return errors.Wrapf(ErrNamespaceOwnedByAnotherEnvironment, "namespace %s (if the API key was rotated while the agent was stopped, delete %s to let the new key claim it)", repo.getNamespace(), ownerKey)
+	}
+
+	return nil
+}
+
+// TransferNamespace hands the namespace over to a rotated API key.
+func (repo *RedisRepository) TransferNamespace(fromApiKey string, toApiKey string) error {
+	transferred, err := transferOwner.Run(repo.client, []string{repo.ownerKey()}, ApiKeyFingerprint(fromApiKey), ApiKeyFingerprint(toApiKey)).Int()
+	if err != nil {
+		return errors.Wrap(err, "error transferring namespace in redis")
+	}
+
+	if transferred == 0 {
+		return errors.Wrapf(ErrNamespaceOwnedByAnotherEnvironment, "namespace %s", repo.getNamespace())
+	}
+
+	return nil
+}
+
+// migrateKeyEncoding rewrites keys written without escaping, once per
+// namespace.
+func (repo *RedisRepository) migrateKeyEncoding() error {
+	encoding, err := repo.client.Get(repo.encodingKey()).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "error getting key encoding from redis")
+	}
+
+	if encoding == KeyEncodingVersion {
+		return nil
+	}
+
+	err = repo.refreshGeneration()
+	if err != nil {
+		return err
+	}
+
+	// only namespaces written before generations were introduced can hold
+	// keys in older encodings, and those are in the first generation
+	migrated := 0
+	repo = repo.generationRepository(repo.currentGeneration())
+	err = repo.scanBatches(fmt.Sprintf("%s:*", repo.dataNamespace()), func(keysWithNamespace []string) error {
+		for _, keyWithNamespace := range keysWithNamespace {
+			key, err := repo.keyWithoutNamespace(keyWithNamespace)
+			if err != nil || repo.keyWithNamespace(key) == keyWithNamespace {
+				continue
+			}
+
+			err = repo.migrateKey(keyWithNamespace, key)
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error migrating key encoding in redis")
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated %d warrants in namespace %s to key encoding %s", migrated, repo.getNamespace(), KeyEncodingVersion)
+	}
+
+	err = repo.client.Set(repo.encodingKey(), KeyEncodingVersion, 0).Err()
+	if err != nil {
+		return errors.Wrap(err, "error setting key encoding in redis")
+	}
+
+	return nil
+}
+
+// migrateKey moves a warrant stored under its legacy encoding to its current
+// one, replacing its index entries.
+func (repo *RedisRepository) migrateKey(legacyKeyWithNamespace string, key WarrantKey) error {
+	err := renameKeyIfAbsent.Run(repo.client, []string{legacyKeyWithNamespace, repo.keyWithNamespace(key)}).Err()
+	if err != nil {
+		return errors.Wrapf(err, "error migrating %s", legacyKeyWithNamespace)
+	}
+
+	pipe := repo.client.TxPipeline()
+	defer pipe.Close()
+
+	if key.Policy != "" {
+		pipe.SRem(fmt.Sprintf("%s:%s", repo.policiesPrefix(), key.WithoutPolicy().legacyString()), string(key.Policy))
+	} else {
+		if key.IsUserset() {
+			pipe.SRem(repo.usersetsKey(key.legacyObjectRelation()), key.Subject.legacyString())
+		}
+		pipe.ZRem(repo.objectsKey(key.legacyObjectsIndexKey()), key.ObjectId)
+		pipe.ZRem(repo.subjectsKey(key.legacyObjectRelation()), key.Subject.legacyString())
+	}
+
+	_, err = pipe.Exec()
+	if err != nil {
+		return errors.Wrapf(err, "error removing legacy index of %s", legacyKeyWithNamespace)
+	}
+
+	return repo.indexKey(key)
+}
+
+func (repo *RedisRepository) getNamespace() string {
+	return repo.namespace
+}
+
+func (repo *RedisRepository) invalidationChannel() string {
+	return fmt.Sprintf("%s.invalidations", repo.getNamespace())
+}
+
+func (repo *RedisRepository) usersetsPrefix() string {
+	return fmt.Sprintf("%s.usersets", repo.dataNamespace())
+}
+
+func (repo *RedisRepository) usersetsKey(objectRelation string) string {
+	return fmt.Sprintf("%s:%s", repo.usersetsPrefix(), objectRelation)
+}
+
+func (repo *RedisRepository) policiesPrefix() string {
+	return fmt.Sprintf("%s.policies", repo.dataNamespace())
+}
+
+func (repo *RedisRepository) policiesKey(key WarrantKey) string {
+	return fmt.Sprintf("%s:%s", repo.policiesPrefix(), key)
+}
+
+func (repo *RedisRepository) objectsPrefix() string {
+	return fmt.Sprintf("%s.objects", repo.dataNamespace())
+}
+
+func (repo *RedisRepository) objectsKey(key string) string {
+	return fmt.Sprintf("%s:%s", repo.objectsPrefix(), key)
+}
+
+func (repo *RedisRepository) subjectsPrefix() string {
+	return fmt.Sprintf("%s.subjects", repo.dataNamespace())
+}
+
+func (repo *RedisRepository) subjectsKey(objectRelation string) string {
+	return fmt.Sprintf("%s:%s", repo.subjectsPrefix(), objectRelation)
+}
+
+// dataNamespace returns the key prefix of the current generation, which for
+// generation 0 is the namespace itself.
+func (repo *RedisRepository) dataNamespace() string {
+	generation := repo.currentGeneration()
+	if generation == 0 {
+		return repo.getNamespace()
+	}
+
+	return fmt.Sprintf("%s.gen%d", repo.getNamespace(), generation)
+}
+
+func (repo *RedisRepository) generationKey() string {
+	return fmt.Sprintf("%s.generation", repo.getNamespace())
+}
+
+func (repo *RedisRepository) nextGenerationKey() string {
+	return fmt.Sprintf("%s.generation.next", repo.getNamespace())
+}
+
+func (repo *RedisRepository) generationsKey() string {
+	return fmt.Sprintf("%s.generations", repo.getNamespace())
+}
+
+func (repo *RedisRepository) lastSyncedKey() string {
+	return fmt.Sprintf("%s.synced", repo.getNamespace())
+}
+
+func (repo *RedisRepository) versionKey() string {
+	return fmt.Sprintf("%s.version", repo.getNamespace())
+}
+
+func (repo *RedisRepository) encodingKey() string {
+	return fmt.Sprintf("%s.encoding", repo.getNamespace())
+}
+
+func (repo *RedisRepository) leaseKey() string {
+	return fmt.Sprintf("%s.leader", repo.getNamespace())
+}
+
+func (repo *RedisRepository) ownerKey() string {
+	return fmt.Sprintf("%s.owner", repo.getNamespace())
+}
+
+func (repo *RedisRepository) keyWithNamespace(key WarrantKey) string {
+	return fmt.Sprintf("%s:%s", repo.dataNamespace(), key)
+}
+
+func (repo *RedisRepository) keyWithoutNamespace(key string) (WarrantKey, error) {
+	return ParseWarrantKey(strings.TrimPrefix(key, fmt.Sprintf("%s:", repo.dataNamespace())))
+}
+
+func parseSubjectKeys(strs []string) ([]SubjectKey, error) {
+	subjects := make([]SubjectKey, len(strs))
+	for i, str := range strs {
+		subject, err := ParseSubjectKey(str)
+		if err != nil {
+			return nil, err
+		}
+		subjects[i] = subject
+	}
+
+	return subjects, nil
+}
+
+type redisLoader struct {
+	repo      *RedisRepository
+	staging   *RedisRepository
+	committed bool
+}
+
+// Add stages warrants and their index entries in a single round trip.
+func (loader *redisLoader) Add(warrants WarrantSet) error {
+	pipe := loader.repo.client.Pipeline()
+	defer pipe.Close()
+
+	for key, count := range warrants {
+		pipe.IncrBy(loader.staging.keyWithNamespace(key), int64(count))
+		loader.staging.addToIndexes(pipe, key)
+	}
+
+	err := loader.keepAlive(pipe)
+	if err != nil {
+		return err
+	}
+
+	_, err = pipe.Exec()
+	if err != nil {
+		return errors.Wrap(err, "error staging warrants in redis")
+	}
+
+	return nil
+}
+
+// keepAlive records that the load is still staging warrants, so that its
+// generation isn't removed as abandoned.
+func (loader *redisLoader) keepAlive(client redis.Cmdable) error {
+	err := client.ZAdd(loader.repo.generationsKey(), redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: loader.staging.generation,
+	}).Err()
+	if err != nil {
+		return errors.Wrap(err, "error recording generation in redis")
+	}
+
+	return nil
+}
+
+func (loader *redisLoader) Commit() error {
+	return loader.commit("", "", "")
+}
+
+func (loader *redisLoader) CommitVersion(baseVersion uint64, version uint64, syncedAt time.Time) error {
+	return loader.commit(strconv.FormatUint(baseVersion, 10), strconv.FormatUint(version, 10), syncedAt.Format(time.RFC3339Nano))
+}
+
+// commit switches to the staged generation, and records version and syncedAt
+// if set.
+func (loader *redisLoader) commit(baseVersion string, version string, syncedAt string) error {
+	repo := loader.repo
+	keys := []string{repo.generationKey(), repo.generationsKey(), repo.leaseKey(), repo.versionKey(), repo.lastSyncedKey()}
+	previous, err := switchGeneration.Run(repo.client, keys, loader.staging.generation, time.Now().Unix(), repo.leaseHolder, baseVersion, version, syncedAt).Result()
+	if err == redis.Nil {
+		return ErrLeaseLost
+	}
+	if err != nil && err.Error() == versionConflictReply {
+		return errors.Wrapf(ErrVersionConflict, "repository is not at version %s", baseVersion)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error switching generation in redis")
+	}
+
+	loader.committed = true
+	repo.setGeneration(loader.staging.generation)
+	log.Printf("Switched namespace %s from generation %v to %d", repo.getNamespace(), previous, loader.staging.generation)
+
+	time.AfterFunc(GenerationRetention, func() {
+		err := repo.removeRetiredGenerations()
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	return repo.publishInvalidation(InvalidateAllKeys)
+}
+
+// Discard removes the staged generation unless it has already been committed.
+func (loader *redisLoader) Discard() error {
+	if loader.committed {
+		return nil
+	}
+
+	err := loader.staging.deleteGeneration()
+	if err != nil {
+		return err
+	}
+
+	err = loader.repo.client.ZRem(loader.repo.generationsKey(), loader.staging.generation).Err()
+	if err != nil {
+		return errors.Wrap(err, "error removing generation from redis")
+	}
+
+	return nil
 }
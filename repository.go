@@ -14,18 +14,76 @@
 
 package edge
 
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
 const (
 	DatastoreMemory = "memory"
 	DatastoreRedis  = "redis"
 )
 
+var (
+	ErrVersionConflict    = errors.New("repository is not at the base version of the delta")
+	ErrExportNotSupported = errors.New("repository cannot be exported")
+	ErrDeltasNotSupported = errors.New("repository does not support delta update files")
+)
+
+// Delta is a set of changes that brings a repository from one version to
+// another, such as a delta update file of the FILE update strategy.
+type Delta struct {
+	BaseVersion uint64
+	Version     uint64
+	Added       WarrantSet
+	Deleted     WarrantSet
+	SyncedAt    time.Time
+}
+
 type IRepository interface {
-	Get(key string) (bool, error)
-	Set(key string, count uint16) error
-	Incr(key string) error
-	Decr(key string) error
+	Get(key WarrantKey) (bool, error)
+	GetMany(keys []WarrantKey) ([]bool, error)
+	GetUsersets(objectRelations []string) ([][]SubjectKey, error)
+	GetPolicies(keys []WarrantKey) ([][]warrant.Policy, error)
+	ListObjects(objectType string, relation string, subject SubjectKey, after string, limit int) ([]string, error)
+	ListSubjects(objectType string, objectId string, relation string, after string, limit int) ([]SubjectKey, error)
+	Set(key WarrantKey, count uint16) error
+	Incr(key WarrantKey) error
+	Decr(key WarrantKey) error
 	Update(warrants WarrantSet) error
+	Load() (IRepositoryLoader, error)
 	Clear() error
 	SetReady(isReady bool)
 	Ready() bool
+	SetLastSynced(lastSynced time.Time) error
+	LastSynced() (time.Time, error)
+	Version() (uint64, error)
+	Datastore() string
+}
+
+// IExportableRepository is a repository whose warrants can all be listed, such
+// as to export a snapshot.
+type IExportableRepository interface {
+	IRepository
+	Range(fn func(key WarrantKey, count uint16) error) error
+}
+
+// IDeltaRepository is a repository that delta update files can be applied to.
+type IDeltaRepository interface {
+	IRepository
+	// ApplyDelta applies the delta at once, or fails with ErrVersionConflict.
+	ApplyDelta(delta Delta) error
+}
+
+// IRepositoryLoader stages warrants that replace a repository's once
+// committed.
+type IRepositoryLoader interface {
+	Add(warrants WarrantSet) error
+	Commit() error
+	// CommitVersion commits along with a version, or fails with
+	// ErrVersionConflict unless the repository is at baseVersion.
+	CommitVersion(baseVersion uint64, version uint64, syncedAt time.Time) error
+	Discard() error
 }
@@ -0,0 +1,103 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// benchmarkWarrants is the number of warrants in the repository each GetMany
+// benchmark looks keys up in.
+const benchmarkWarrants = 10000
+
+func BenchmarkGetMany(b *testing.B) {
+	repos := map[string]func(b *testing.B) IRepository{
+		DatastoreMemory: func(b *testing.B) IRepository {
+			return NewMemoryRepository()
+		},
+		DatastoreRedis: newBenchmarkRedisRepository,
+	}
+
+	for _, datastore := range []string{DatastoreMemory, DatastoreRedis} {
+		b.Run(datastore, func(b *testing.B) {
+			repo := repos[datastore](b)
+			warrants := make(WarrantSet, benchmarkWarrants)
+			for i := 0; i < benchmarkWarrants; i++ {
+				warrants[benchmarkKey(i)] = 1
+			}
+			err := repo.Update(warrants)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, n := range []int{1, 10, 100} {
+				// look up as many keys that exist as keys that don't
+				keys := make([]WarrantKey, n)
+				for i := range keys {
+					if i%2 == 0 {
+						keys[i] = benchmarkKey(i)
+					} else {
+						keys[i] = benchmarkKey(benchmarkWarrants + i)
+					}
+				}
+
+				b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						_, err := repo.GetMany(keys)
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// newBenchmarkRedisRepository connects to the redis server at REDIS_HOSTNAME
+// and REDIS_PORT, or the default local one, skipping the benchmark if there
+// isn't one.
+func newBenchmarkRedisRepository(b *testing.B) IRepository {
+	repo, err := NewRedisRepository(RedisRepositoryConfig{
+		Hostname:  os.Getenv("REDIS_HOSTNAME"),
+		Port:      os.Getenv("REDIS_PORT"),
+		Namespace: "warrant-benchmark",
+	})
+	if err != nil {
+		b.Skipf("redis unavailable: %s", err)
+	}
+
+	b.Cleanup(func() {
+		err := repo.Clear()
+		if err != nil {
+			b.Error(err)
+		}
+	})
+	return repo
+}
+
+func benchmarkKey(i int) WarrantKey {
+	return WarrantKey{
+		ObjectType: "document",
+		ObjectId:   fmt.Sprintf("%d", i),
+		Relation:   "viewer",
+		Subject: SubjectKey{
+			ObjectType: "user",
+			ObjectId:   fmt.Sprintf("%d", i%100),
+		},
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidObjectTypePattern = errors.New("invalid object type pattern")
+
+// ObjectTypeFilter limits the warrants an agent syncs to object types matching
+// glob patterns such as "account-*", excluding those prefixed with "!".
+type ObjectTypeFilter struct {
+	include []string
+	exclude []string
+}
+
+func NewObjectTypeFilter(patterns []string) (*ObjectTypeFilter, error) {
+	filter := &ObjectTypeFilter{
+		include: make([]string, 0),
+		exclude: make([]string, 0),
+	}
+
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, errors.Wrapf(ErrInvalidObjectTypePattern, "%q", pattern)
+		}
+
+		if exclude {
+			filter.exclude = append(filter.exclude, pattern)
+		} else {
+			filter.include = append(filter.include, pattern)
+		}
+	}
+
+	return filter, nil
+}
+
+// Includes reports whether warrants on objectType are in scope. A nil filter
+// includes every type.
+func (filter *ObjectTypeFilter) Includes(objectType string) bool {
+	if filter == nil {
+		return true
+	}
+
+	for _, pattern := range filter.exclude {
+		if match, _ := path.Match(pattern, objectType); match {
+			return false
+		}
+	}
+
+	if len(filter.include) == 0 {
+		return true
+	}
+
+	for _, pattern := range filter.include {
+		if match, _ := path.Match(pattern, objectType); match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter removes the warrants on object types that are out of scope from
+// warrants, returning it.
+func (filter *ObjectTypeFilter) Filter(warrants WarrantSet) WarrantSet {
+	if filter == nil {
+		return warrants
+	}
+
+	for key := range warrants {
+		if !filter.Includes(key.ObjectType) {
+			delete(warrants, key)
+		}
+	}
+
+	return warrants
+}
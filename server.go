@@ -15,12 +15,23 @@
 package edge
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	check "github.com/warrant-dev/warrant/pkg/authz/check"
 	"github.com/warrant-dev/warrant/pkg/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -29,36 +40,147 @@ const (
 	OpAllOf             = "allOf"
 	ResultAuthorized    = "Authorized"
 	ResultNotAuthorized = "Not Authorized"
+	MaxBatchChecks      = 1000
+	MaxCheckWarrants    = 100
+	MaxUsersetDepth     = 4
+	MaxRequestBodySize  = 1 << 20
+	DefaultPort         = 3000
+	DefaultSocketMode   = 0660
+
+	HeaderDecisionSource   = "Warrant-Decision-Source"
+	DecisionSourceCache    = "cache"
+	DecisionSourceUpstream = "upstream"
 )
 
+var ErrIncompleteTLSConfig = errors.New("TLS requires both a certificate and key file")
+
 type ServerConfig struct {
-	ApiKey     string
-	Port       int
-	Repository IRepository
+	ApiKey             string
+	ClientApiKeys      []string
+	DisableAuth        bool
+	DisableRequestLogs bool
+	ListenAddress      string
+	Port               int
+	SocketPath         string
+	SocketMode         os.FileMode
+	AdminListenAddress string
+	AdminPort          int
+	GrpcPort           int
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSClientCAFile    string
+	ObjectTypes        *ObjectTypeFilter
+	Repository         IRepository
+	Upstream           *Upstream
+	Client             *Client
+	Tenants            []*Tenant
 }
 
 type Server struct {
-	config ServerConfig
+	config  ServerConfig
+	tenants map[string]*Tenant
+	lock    sync.RWMutex
 }
 
 func NewServer(config ServerConfig) (*Server, error) {
+	hasApiKeys := config.ApiKey != "" || len(config.ClientApiKeys) > 0
+	tenants := make(map[string]*Tenant)
+	for _, tenant := range config.Tenants {
+		if _, exists := tenants[tenant.Name()]; exists {
+			return nil, errors.Wrapf(ErrDuplicateTenantName, "tenant %s", tenant.Name())
+		}
+
+		if !config.DisableAuth && !hasApiKeys && len(tenant.apiKeys()) == 0 {
+			return nil, errors.Wrapf(ErrMissingApiKey, "tenant %s", tenant.Name())
+		}
+
+		tenants[tenant.Name()] = tenant
+	}
+
+	if len(config.Tenants) == 0 {
+		if config.Repository == nil {
+			return nil, ErrMissingRepository
+		}
+
+		// agents used to serve checks without authentication, so keep doing
+		// so when no keys are configured until authentication is enforced
+		if !config.DisableAuth && !hasApiKeys {
+			log.Println("WARNING: No API keys are configured, so check requests are not authenticated. A future release will refuse to start without API keys unless authentication is explicitly disabled.")
+			config.DisableAuth = true
+		}
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, ErrIncompleteTLSConfig
+	}
+
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		return nil, ErrIncompleteTLSConfig
+	}
+
+	if config.Port == 0 {
+		config.Port = DefaultPort
+	}
+
+	if config.SocketMode == 0 {
+		config.SocketMode = DefaultSocketMode
+	}
+
 	return &Server{
-		config: config,
+		config:  config,
+		tenants: tenants,
 	}, nil
 }
 
+// HealthSpec reports whether the agent is ready and, without tenants, the
+// state of its sync.
+type HealthSpec struct {
+	Ready        bool       `json:"ready"`
+	LastSyncedAt *time.Time `json:"lastSyncedAt,omitempty"`
+	Version      uint64     `json:"version,omitempty"`
+	Rejected     uint64     `json:"rejected,omitempty"`
+}
+
 func (server *Server) health(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if server.config.Repository.Ready() {
+	health := HealthSpec{
+		Ready: server.ready(),
+	}
+	if len(server.config.Tenants) == 0 {
+		lastSynced, err := server.config.Repository.LastSynced()
+		if err != nil {
+			log.Println(errors.Wrap(err, "error getting last synced time"))
+		} else if !lastSynced.IsZero() {
+			health.LastSyncedAt = &lastSynced
+		}
+
+		version, err := server.config.Repository.Version()
+		if err != nil {
+			log.Println(errors.Wrap(err, "error getting version"))
+		} else {
+			health.Version = version
+		}
+
+		if server.config.Client != nil {
+			health.Rejected = server.config.Client.Rejected()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Ready {
 		w.WriteHeader(http.StatusOK)
-		return
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
 	}
 
-	w.WriteHeader(http.StatusInternalServerError)
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		log.Println(errors.Wrap(err, "error writing health response"))
+	}
 }
 
 func (server *Server) check(w http.ResponseWriter, r *http.Request) {
@@ -67,92 +189,330 @@ func (server *Server) check(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !server.config.Repository.Ready() {
+	if !server.repository(r.Context()).Ready() && server.upstream(r.Context()) == nil {
 		service.SendErrorResponse(w, NewCacheNotReady())
 		return
 	}
 
 	var checkManySpec check.CheckManySpec
-	err := service.ParseJSONBody(r.Context(), r.Body, &checkManySpec)
+	err := parseJSONBody(w, r, &checkManySpec)
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	checkResult, decisionSource, err := server.checkMany(r.Context(), checkManySpec)
 	if err != nil {
 		service.SendErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set(HeaderDecisionSource, decisionSource)
+	service.SendJSONResponse(w, checkResult)
+}
+
+func (server *Server) batchCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	var code int64
-	var result string
-	switch checkManySpec.Op {
-	case OpAnyOf:
-		code = http.StatusForbidden
-		result = ResultNotAuthorized
-
-		for _, wnt := range checkManySpec.Warrants {
-			match, err := server.config.Repository.Get(wnt.String())
-			if err != nil {
-				service.SendErrorResponse(w, err)
-				return
-			}
-
-			if match {
-				code = http.StatusOK
-				result = ResultAuthorized
-				break
-			}
-		}
-	case OpAllOf:
-		code = http.StatusOK
-		result = ResultAuthorized
-
-		for _, wnt := range checkManySpec.Warrants {
-			match, err := server.config.Repository.Get(wnt.String())
-			if err != nil {
-				service.SendErrorResponse(w, err)
-				return
-			}
-
-			if !match {
-				code = http.StatusForbidden
-				result = ResultNotAuthorized
-				break
-			}
-		}
-	default:
-		if checkManySpec.Op != "" {
-			service.SendErrorResponse(w, service.NewInvalidParameterError("op", "must be one of anyOf or allOf"))
+	if !server.repository(r.Context()).Ready() {
+		service.SendErrorResponse(w, NewCacheNotReady())
+		return
+	}
+
+	var checkManySpecs []check.CheckManySpec
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBodySize)
+	err := json.NewDecoder(r.Body).Decode(&checkManySpecs)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			service.SendErrorResponse(w, NewRequestTooLarge(MaxRequestBodySize))
 			return
 		}
 
-		if len(checkManySpec.Warrants) > 1 {
-			service.SendErrorResponse(w, service.NewInvalidParameterError("op", "must include operator when including multiple warrants"))
+		service.SendErrorResponse(w, service.NewInvalidRequestError("Request must be a JSON array of checks"))
+		return
+	}
+
+	checkResults, err := server.batchCheckMany(r.Context(), checkManySpecs)
+	if err != nil {
+		service.SendErrorResponse(w, err)
+		return
+	}
+
+	service.SendJSONResponse(w, checkResults)
+}
+
+// parseJSONBody parses and validates a JSON request body of at most
+// MaxRequestBodySize bytes into obj.
+func parseJSONBody(w http.ResponseWriter, r *http.Request, obj interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBodySize)
+	err := service.ParseJSONBody(r.Context(), r.Body, obj)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return NewRequestTooLarge(MaxRequestBodySize)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// authenticate requires the server's or a client API key, routing requests to
+// their tenant if there are any.
+func (server *Server) authenticate(next http.Handler) http.Handler {
+	if len(server.config.Tenants) > 0 {
+		return server.tenantMiddleware(next)
+	}
+
+	if server.config.DisableAuth {
+		return next
+	}
+
+	return apiKeyAuthMiddleware(server.apiKeys, next)
+}
+
+// SetApiKeys rotates the server's API key and client API keys. Unless
+// authentication is disabled, a server without tenants must keep at least one.
+func (server *Server) SetApiKeys(apiKey string, clientApiKeys []string) error {
+	if !server.config.DisableAuth && len(server.config.Tenants) == 0 && apiKey == "" && len(clientApiKeys) == 0 {
+		return ErrMissingApiKey
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.config.ApiKey = apiKey
+	server.config.ClientApiKeys = clientApiKeys
+	return nil
+}
+
+// SetRequestLogs turns logging of each request served on or off.
+func (server *Server) SetRequestLogs(enabled bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.config.DisableRequestLogs = !enabled
+}
+
+func (server *Server) apiKeys() []string {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	apiKeys := make([]string, 0)
+	if server.config.ApiKey != "" {
+		apiKeys = append(apiKeys, server.config.ApiKey)
+	}
+
+	return append(apiKeys, server.config.ClientApiKeys...)
+}
+
+// authenticateAdmin requires the server's own API key.
+func (server *Server) authenticateAdmin(next http.Handler) http.Handler {
+	return apiKeyAuthMiddleware(server.adminApiKeys, next)
+}
+
+// authenticateExport requires the server's API key for requests exporting an
+// environment's warrants and routes them to their tenant.
+func (server *Server) authenticateExport(next http.Handler) http.Handler {
+	return server.authenticateAdmin(server.authenticate(next))
+}
+
+func (server *Server) adminApiKeys() []string {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	if server.config.ApiKey == "" {
+		return []string{}
+	}
+
+	return []string{server.config.ApiKey}
+}
+
+// logRequests logs the requests next serves unless request logs are disabled.
+func (server *Server) logRequests(next http.Handler) http.Handler {
+	logged := loggingMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.RLock()
+		disabled := server.config.DisableRequestLogs
+		server.lock.RUnlock()
+		if disabled {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		match, err := server.config.Repository.Get(checkManySpec.Warrants[0].String())
+		logged.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) Run() error {
+	errs := make(chan error, 3)
+	mux := http.NewServeMux()
+	if server.config.AdminPort != 0 {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/health", server.logRequests(http.HandlerFunc(server.health)))
+		if len(server.config.Tenants) > 0 {
+			adminMux.Handle("/tenants", server.logRequests(http.HandlerFunc(server.tenantStatus)))
+		}
+		server.handleSnapshots(adminMux, server.routeTenant)
+
+		adminListener, err := net.Listen("tcp", net.JoinHostPort(server.config.AdminListenAddress, strconv.Itoa(server.config.AdminPort)))
 		if err != nil {
-			service.SendErrorResponse(w, err)
-			return
+			return errors.Wrap(err, "error starting admin listener")
 		}
 
-		if match {
-			code = http.StatusOK
-			result = ResultAuthorized
-		} else {
-			code = http.StatusForbidden
-			result = ResultNotAuthorized
+		log.Printf("Edge agent serving admin requests on %s", adminListener.Addr())
+		go func() {
+			errs <- http.Serve(adminListener, adminMux)
+		}()
+	} else {
+		mux.Handle("/health", server.logRequests(http.HandlerFunc(server.health)))
+		if len(server.config.Tenants) > 0 {
+			mux.Handle("/tenants", server.logRequests(server.authenticateAdmin(http.HandlerFunc(server.tenantStatus))))
 		}
+		server.handleSnapshots(mux, server.authenticateExport)
 	}
 
-	service.SendJSONResponse(w, check.CheckResultSpec{
-		Code:   code,
-		Result: result,
-	})
+	routes := map[string]http.HandlerFunc{
+		fmt.Sprintf("/%s/authorize", ApiVersion):     server.check,
+		fmt.Sprintf("/%s/check", ApiVersion):         server.check,
+		fmt.Sprintf("/%s/check/batch", ApiVersion):   server.batchCheck,
+		fmt.Sprintf("/%s/list/objects", ApiVersion):  server.listObjects,
+		fmt.Sprintf("/%s/list/subjects", ApiVersion): server.listSubjects,
+	}
+	for path, handler := range routes {
+		mux.Handle(path, server.logRequests(server.authenticate(handler)))
+		if len(server.config.Tenants) > 0 {
+			mux.Handle(fmt.Sprintf("/tenants/{tenant}%s", path), server.logRequests(server.authenticate(handler)))
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if server.config.TLSCertFile != "" {
+		config, err := newTLSConfig(server.config.TLSCertFile, server.config.TLSKeyFile, server.config.TLSClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "error configuring TLS")
+		}
+		tlsConfig = config
+	}
+
+	if server.config.GrpcPort != 0 {
+		grpcListener, err := net.Listen("tcp", net.JoinHostPort(server.config.ListenAddress, strconv.Itoa(server.config.GrpcPort)))
+		if err != nil {
+			return errors.Wrap(err, "error starting gRPC listener")
+		}
+
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+
+		log.Printf("Edge agent ready to serve gRPC authz requests on %s", grpcListener.Addr())
+		go func() {
+			errs <- newGrpcServer(server, opts...).Serve(grpcListener)
+		}()
+	}
+
+	listener, err := server.listen()
+	if err != nil {
+		return errors.Wrap(err, "error starting listener")
+	}
+
+	httpServer := &http.Server{
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		log.Printf("Edge agent ready to serve authz requests over TLS on %s", listener.Addr())
+		go func() {
+			errs <- httpServer.ServeTLS(listener, "", "")
+		}()
+	} else {
+		log.Printf("Edge agent ready to serve authz requests on %s", listener.Addr())
+		go func() {
+			errs <- httpServer.Serve(listener)
+		}()
+	}
+
+	return <-errs
 }
 
-func (server *Server) Run() error {
-	mux := http.NewServeMux()
-	mux.Handle("/health", loggingMiddleware(http.HandlerFunc(server.health)))
-	mux.Handle(fmt.Sprintf("/%s/authorize", ApiVersion), loggingMiddleware(http.HandlerFunc(server.check)))
-	mux.Handle(fmt.Sprintf("/%s/check", ApiVersion), loggingMiddleware(http.HandlerFunc(server.check)))
+// handleSnapshots registers the snapshot export endpoints behind middleware.
+func (server *Server) handleSnapshots(mux *http.ServeMux, middleware func(http.Handler) http.Handler) {
+	mux.Handle("/snapshot", server.logRequests(middleware(http.HandlerFunc(server.exportSnapshot))))
+	if len(server.config.Tenants) > 0 {
+		mux.Handle("/tenants/{tenant}/snapshot", server.logRequests(middleware(http.HandlerFunc(server.exportSnapshot))))
+	}
+}
+
+// listen opens the server's unix socket if one is configured, otherwise its
+// TCP address.
+func (server *Server) listen() (net.Listener, error) {
+	if server.config.SocketPath == "" {
+		return net.Listen("tcp", net.JoinHostPort(server.config.ListenAddress, strconv.Itoa(server.config.Port)))
+	}
+
+	// remove a socket left behind by a previous run
+	info, err := os.Stat(server.config.SocketPath)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(server.config.SocketPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "error removing stale socket")
+		}
+	}
+
+	// create the socket in a private directory and move it into place once
+	// its permissions are set
+	dir, err := os.MkdirTemp(filepath.Dir(server.config.SocketPath), ".edge-agent-")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating socket")
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tempPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket won't be at tempPath by the time the listener is closed
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tempPath, server.config.SocketMode)
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "error setting socket permissions")
+	}
+
+	err = os.Rename(tempPath, server.config.SocketPath)
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "error creating socket")
+	}
+
+	return &socketListener{
+		Listener: listener,
+		addr:     &net.UnixAddr{Name: server.config.SocketPath, Net: "unix"},
+	}, nil
+}
+
+// socketListener removes the socket from where it was moved to when closed.
+type socketListener struct {
+	net.Listener
+	addr *net.UnixAddr
+}
+
+func (listener *socketListener) Addr() net.Addr {
+	return listener.addr
+}
+
+func (listener *socketListener) Close() error {
+	err := listener.Listener.Close()
+	removeErr := os.Remove(listener.addr.Name)
+	if err == nil && removeErr != nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
 
-	log.Printf("Edge agent ready to serve authz requests on port %d", server.config.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", server.config.Port), mux)
+	return err
 }
@@ -0,0 +1,442 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
+
+func TestCheckHandlers(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		status  int
+		code    string
+		result  string
+	}{
+		{
+			name:    "check authorized",
+			handler: server.check,
+			body:    testCheckBody(1),
+			status:  http.StatusOK,
+			result:  ResultAuthorized,
+		},
+		{
+			name:    "check not authorized",
+			handler: server.check,
+			body:    `{"warrants":[{"objectType":"document","objectId":"2","relation":"viewer","subject":{"objectType":"user","objectId":"1"}}]}`,
+			status:  http.StatusOK,
+			result:  ResultNotAuthorized,
+		},
+		{
+			name:    "check wrong method",
+			handler: server.check,
+			method:  http.MethodGet,
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "check malformed body",
+			handler: server.check,
+			body:    `{"warrants":[`,
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "check oversized body",
+			handler: server.check,
+			body:    fmt.Sprintf(`{"op":"anyOf","context":{"padding":"%s"}}`, strings.Repeat("a", MaxRequestBodySize)),
+			status:  http.StatusRequestEntityTooLarge,
+			code:    ErrorRequestTooLarge,
+		},
+		{
+			name:    "check missing warrants",
+			handler: server.check,
+			body:    `{"op":"anyOf"}`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_parameter",
+		},
+		{
+			name:    "check missing object id",
+			handler: server.check,
+			body:    `{"warrants":[{"objectType":"document","relation":"viewer","subject":{"objectType":"user","objectId":"1"}}]}`,
+			status:  http.StatusBadRequest,
+			code:    "missing_required_parameter",
+		},
+		{
+			name:    "check missing subject",
+			handler: server.check,
+			body:    `{"warrants":[{"objectType":"document","objectId":"1","relation":"viewer"}]}`,
+			status:  http.StatusBadRequest,
+			code:    "missing_required_parameter",
+		},
+		{
+			name:    "check missing op",
+			handler: server.check,
+			body:    strings.Replace(testCheckBody(2), `"op":"anyOf"`, `"op":""`, 1),
+			status:  http.StatusBadRequest,
+			code:    "invalid_parameter",
+		},
+		{
+			name:    "check too many warrants",
+			handler: server.check,
+			body:    testCheckBody(MaxCheckWarrants + 1),
+			status:  http.StatusBadRequest,
+			code:    "invalid_parameter",
+		},
+		{
+			name:    "batch check authorized",
+			handler: server.batchCheck,
+			body:    fmt.Sprintf("[%s,%s]", testCheckBody(1), testCheckBody(MaxCheckWarrants)),
+			status:  http.StatusOK,
+			result:  ResultAuthorized,
+		},
+		{
+			name:    "batch check wrong method",
+			handler: server.batchCheck,
+			method:  http.MethodGet,
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "batch check malformed body",
+			handler: server.batchCheck,
+			body:    testCheckBody(1),
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+		},
+		{
+			name:    "batch check oversized body",
+			handler: server.batchCheck,
+			body:    "[" + strings.Repeat(testCheckBody(1)+",", MaxRequestBodySize/len(testCheckBody(1))) + testCheckBody(1) + "]",
+			status:  http.StatusRequestEntityTooLarge,
+			code:    ErrorRequestTooLarge,
+		},
+		{
+			name:    "batch check no checks",
+			handler: server.batchCheck,
+			body:    `[]`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+		},
+		{
+			name:    "batch check too many checks",
+			handler: server.batchCheck,
+			body:    "[" + strings.Repeat(`{"warrants":[]},`, MaxBatchChecks) + `{"warrants":[]}]`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+		},
+		{
+			name:    "batch check missing warrants",
+			handler: server.batchCheck,
+			body:    fmt.Sprintf(`[%s,{"op":"anyOf"}]`, testCheckBody(1)),
+			status:  http.StatusBadRequest,
+			code:    "invalid_parameter",
+		},
+		{
+			name:    "batch check too many warrants",
+			handler: server.batchCheck,
+			body:    fmt.Sprintf("[%s,%s]", testCheckBody(1), testCheckBody(MaxCheckWarrants+1)),
+			status:  http.StatusBadRequest,
+			code:    "invalid_parameter",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+
+			w := httptest.NewRecorder()
+			test.handler(w, httptest.NewRequest(method, "/", strings.NewReader(test.body)))
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+
+			if test.code != "" {
+				var response struct {
+					Code string `json:"code"`
+				}
+				err := json.Unmarshal(w.Body.Bytes(), &response)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if response.Code != test.code {
+					t.Errorf("expected error code %s, got %s", test.code, response.Code)
+				}
+			}
+
+			if test.result != "" {
+				var results []check.CheckResultSpec
+				body := w.Body.String()
+				if !strings.HasPrefix(body, "[") {
+					body = "[" + body + "]"
+				}
+
+				err := json.Unmarshal([]byte(body), &results)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, result := range results {
+					if result.Result != test.result {
+						t.Errorf("expected result %s, got %s", test.result, result.Result)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCheckHandlersNotReady(t *testing.T) {
+	repo := NewMemoryRepository()
+	repo.SetReady(false)
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		Repository:  repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, handler := range []http.HandlerFunc{server.check, server.batchCheck} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("["+testCheckBody(1)+"]")))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body)
+		}
+	}
+}
+
+// newTestServer returns a server without authentication whose repository
+// holds a warrant making user:1 a viewer of document:1.
+func newTestServer(t *testing.T) *Server {
+	repo := NewMemoryRepository()
+	err := repo.Update(WarrantSet{
+		NewWarrantKey(testCheckWarrant()): 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.SetReady(true)
+
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		Repository:  repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+func testCheckWarrant() check.CheckWarrantSpec {
+	return check.CheckWarrantSpec{
+		ObjectType: "document",
+		ObjectId:   "1",
+		Relation:   "viewer",
+		Subject: &warrant.SubjectSpec{
+			ObjectType: "user",
+			ObjectId:   "1",
+		},
+	}
+}
+
+// testCheckBody returns the body of an anyOf check of n copies of the test
+// warrant.
+func testCheckBody(n int) string {
+	warrants := make([]check.CheckWarrantSpec, n)
+	for i := range warrants {
+		warrants[i] = testCheckWarrant()
+	}
+
+	body, err := json.Marshal(check.CheckManySpec{
+		Op:       OpAnyOf,
+		Warrants: warrants,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return string(body)
+}
+
+func TestTenantStatusRequiresServerApiKey(t *testing.T) {
+	tenant, err := NewTenant(TenantConfig{
+		Name:       "acme",
+		ApiKey:     "tenant-key",
+		Repository: NewMemoryRepository(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serverApiKey := range []string{"server-key", ""} {
+		server, err := NewServer(ServerConfig{
+			ApiKey:  serverApiKey,
+			Tenants: []*Tenant{tenant},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := server.authenticateAdmin(http.HandlerFunc(server.tenantStatus))
+		for _, apiKey := range []string{"", "tenant-key", "server-key"} {
+			r := httptest.NewRequest(http.MethodGet, "/tenants", nil)
+			if apiKey != "" {
+				r.Header.Set("Authorization", fmt.Sprintf("%s %s", AuthTypeApiKey, apiKey))
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			expected := http.StatusUnauthorized
+			if serverApiKey != "" && apiKey == serverApiKey {
+				expected = http.StatusOK
+			}
+
+			if w.Code != expected {
+				t.Errorf("server key %q, request key %q: expected status %d, got %d", serverApiKey, apiKey, expected, w.Code)
+			}
+		}
+	}
+}
+
+func TestSnapshotExportRequiresServerApiKey(t *testing.T) {
+	tenant, err := NewTenant(TenantConfig{
+		Name:       "acme",
+		ApiKey:     "tenant-key",
+		Repository: NewMemoryRepository(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(ServerConfig{
+		ApiKey:        "server-key",
+		ClientApiKeys: []string{"client-key"},
+		Tenants:       []*Tenant{tenant},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	server.handleSnapshots(mux, server.authenticateExport)
+	adminMux := http.NewServeMux()
+	server.handleSnapshots(adminMux, server.routeTenant)
+	tests := []struct {
+		mux    *http.ServeMux
+		path   string
+		apiKey string
+		status int
+	}{
+		{mux: mux, path: "/tenants/acme/snapshot", status: http.StatusUnauthorized},
+		{mux: mux, path: "/tenants/acme/snapshot", apiKey: "client-key", status: http.StatusUnauthorized},
+		{mux: mux, path: "/tenants/acme/snapshot", apiKey: "tenant-key", status: http.StatusUnauthorized},
+		{mux: mux, path: "/tenants/acme/snapshot", apiKey: "server-key", status: http.StatusOK},
+		{mux: adminMux, path: "/tenants/acme/snapshot", status: http.StatusOK},
+		{mux: adminMux, path: "/tenants/initech/snapshot", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.apiKey != "" {
+			r.Header.Set("Authorization", fmt.Sprintf("%s %s", AuthTypeApiKey, test.apiKey))
+		}
+
+		w := httptest.NewRecorder()
+		test.mux.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s with key %q: expected status %d, got %d", test.path, test.apiKey, test.status, w.Code)
+		}
+	}
+}
+
+func TestListenSocketRemovedOnClose(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "edge.sock")
+	server, err := NewServer(ServerConfig{
+		DisableAuth: true,
+		Repository:  NewMemoryRepository(),
+		SocketPath:  socketPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != DefaultSocketMode {
+		t.Errorf("expected socket mode %o, got %o", DefaultSocketMode, info.Mode().Perm())
+	}
+
+	err = listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("expected %s to be removed", entry.Name())
+	}
+}
+
+func TestParseApiKey(t *testing.T) {
+	tests := []struct {
+		header string
+		apiKey string
+		valid  bool
+	}{
+		{header: "ApiKey key", apiKey: "key", valid: true},
+		{header: "ApiKey", valid: false},
+		{header: "ApiKey ", valid: false},
+		{header: "Bearer key", valid: false},
+		{header: "", valid: false},
+	}
+
+	for _, test := range tests {
+		apiKey, err := parseApiKey(test.header)
+		if test.valid && (err != nil || apiKey != test.apiKey) {
+			t.Errorf("%q: expected key %q, got %q (%v)", test.header, test.apiKey, apiKey, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected header to be invalid, got key %q", test.header, apiKey)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidPublicKey = errors.New("invalid public key (must be a base64-encoded Ed25519 key)")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// ParsePublicKey decodes a base64-encoded Ed25519 public key, either the raw
+// 32-byte key or its DER-encoded PKIX form.
+func ParsePublicKey(str string) (ed25519.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrInvalidPublicKey
+	}
+
+	return publicKey, nil
+}
+
+// VerifySignature checks that signature, a base64-encoded Ed25519 signature,
+// was made over data with the private key of publicKey.
+func VerifySignature(publicKey ed25519.PublicKey, data []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(publicKey, data, sig) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// VerifyDigestSignature verifies an Ed25519ph signature given the SHA-512
+// digest of the message.
+func VerifyDigestSignature(publicKey ed25519.PublicKey, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || ed25519.VerifyWithOptions(publicKey, digest, sig, &ed25519.Options{Hash: crypto.SHA512}) != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,462 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warrant-dev/warrant/pkg/service"
+)
+
+// A snapshot is a gzip-compressed file of JSON lines capturing the warrants in
+// a repository:
+//
+//	{"format":"warrant-edge-snapshot","version":1,"syncedAt":"2024-05-01T12:00:00Z"}
+//	{"warrant":"document:1#viewer@user:1","count":1}
+//	{"warrant":"document:1#viewer@group:eng#member","count":1}
+//	{"entries":2,"checksum":"sha256:<hex>"}
+//
+// The trailer holds the number of entries and the SHA-256 of the entry lines.
+// A delta has "kind":"delta" in its header, and entries with "delete":true
+// remove warrants. Update files also sign "updateVersion" and, for deltas,
+// "baseVersion" in their header.
+const (
+	SnapshotFormat    = "warrant-edge-snapshot"
+	SnapshotVersion   = 1
+	SnapshotKindDelta = "delta"
+
+	checksumPrefix = "sha256:"
+)
+
+var (
+	ErrInvalidSnapshot            = errors.New("invalid snapshot")
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksumMismatch   = errors.New("snapshot checksum mismatch")
+)
+
+type SnapshotHeader struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	Kind          string    `json:"kind,omitempty"`
+	SyncedAt      time.Time `json:"syncedAt"`
+	UpdateVersion uint64    `json:"updateVersion,omitempty"`
+	BaseVersion   uint64    `json:"baseVersion,omitempty"`
+}
+
+type SnapshotEntry struct {
+	Warrant WarrantKey `json:"warrant"`
+	Count   uint16     `json:"count"`
+	Delete  bool       `json:"delete,omitempty"`
+}
+
+type snapshotTrailer struct {
+	Entries  int    `json:"entries"`
+	Checksum string `json:"checksum"`
+}
+
+// SnapshotWriter writes a snapshot one warrant at a time. Close must be called
+// to write the trailer.
+type SnapshotWriter struct {
+	kind       string
+	gzipWriter *gzip.Writer
+	checksum   hash.Hash
+	entries    int
+}
+
+func NewSnapshotWriter(w io.Writer, syncedAt time.Time) (*SnapshotWriter, error) {
+	return newSnapshotWriter(w, SnapshotHeader{
+		SyncedAt: syncedAt,
+	})
+}
+
+// NewDeltaWriter returns a writer for a delta, which may also delete warrants.
+func NewDeltaWriter(w io.Writer, syncedAt time.Time) (*SnapshotWriter, error) {
+	return newSnapshotWriter(w, SnapshotHeader{
+		Kind:     SnapshotKindDelta,
+		SyncedAt: syncedAt,
+	})
+}
+
+// NewUpdateSnapshotWriter returns a writer for a snapshot update file that
+// brings a repository to version.
+func NewUpdateSnapshotWriter(w io.Writer, syncedAt time.Time, version uint64) (*SnapshotWriter, error) {
+	return newSnapshotWriter(w, SnapshotHeader{
+		SyncedAt:      syncedAt,
+		UpdateVersion: version,
+	})
+}
+
+// NewUpdateDeltaWriter returns a writer for a delta update file that brings a
+// repository from baseVersion to version.
+func NewUpdateDeltaWriter(w io.Writer, syncedAt time.Time, baseVersion uint64, version uint64) (*SnapshotWriter, error) {
+	return newSnapshotWriter(w, SnapshotHeader{
+		Kind:          SnapshotKindDelta,
+		SyncedAt:      syncedAt,
+		UpdateVersion: version,
+		BaseVersion:   baseVersion,
+	})
+}
+
+func newSnapshotWriter(w io.Writer, header SnapshotHeader) (*SnapshotWriter, error) {
+	kind := header.Kind
+	header.Format = SnapshotFormat
+	header.Version = SnapshotVersion
+	header.SyncedAt = header.SyncedAt.UTC()
+
+	gzipWriter := gzip.NewWriter(w)
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gzipWriter.Write(append(line, '\n'))
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing snapshot header")
+	}
+
+	return &SnapshotWriter{
+		kind:       kind,
+		gzipWriter: gzipWriter,
+		checksum:   sha256.New(),
+	}, nil
+}
+
+func (writer *SnapshotWriter) Write(key WarrantKey, count uint16) error {
+	return writer.writeEntry(SnapshotEntry{
+		Warrant: key,
+		Count:   count,
+	})
+}
+
+// Delete writes the removal of count of a warrant to a delta.
+func (writer *SnapshotWriter) Delete(key WarrantKey, count uint16) error {
+	if writer.kind != SnapshotKindDelta {
+		return errors.Wrap(ErrInvalidSnapshot, "only deltas can delete warrants")
+	}
+
+	return writer.writeEntry(SnapshotEntry{
+		Warrant: key,
+		Count:   count,
+		Delete:  true,
+	})
+}
+
+func (writer *SnapshotWriter) writeEntry(entry SnapshotEntry) error {
+	key := entry.Warrant
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	writer.checksum.Write(line)
+	writer.entries++
+	_, err = writer.gzipWriter.Write(line)
+	if err != nil {
+		return errors.Wrapf(err, "error writing warrant %s to snapshot", key)
+	}
+
+	return nil
+}
+
+// Close writes the snapshot's trailer and flushes it. It does not close the
+// underlying writer.
+func (writer *SnapshotWriter) Close() error {
+	trailer, err := json.Marshal(snapshotTrailer{
+		Entries:  writer.entries,
+		Checksum: checksumPrefix + hex.EncodeToString(writer.checksum.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.gzipWriter.Write(append(trailer, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "error writing snapshot trailer")
+	}
+
+	return writer.gzipWriter.Close()
+}
+
+// SnapshotReader reads a snapshot one warrant at a time, verifying its
+// checksum once every warrant has been read.
+type SnapshotReader struct {
+	header   SnapshotHeader
+	reader   *bufio.Reader
+	checksum hash.Hash
+	entries  int
+	done     bool
+}
+
+func NewSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+
+	reader := &SnapshotReader{
+		reader:   bufio.NewReader(gzipReader),
+		checksum: sha256.New(),
+	}
+
+	line, err := reader.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(line, &reader.header)
+	if err != nil || reader.header.Format != SnapshotFormat {
+		return nil, errors.Wrap(ErrInvalidSnapshot, "missing header")
+	}
+
+	if reader.header.Version < 1 || reader.header.Version > SnapshotVersion {
+		return nil, errors.Wrapf(ErrUnsupportedSnapshotVersion, "%d", reader.header.Version)
+	}
+
+	if reader.header.Kind != "" && reader.header.Kind != SnapshotKindDelta {
+		return nil, errors.Wrapf(ErrInvalidSnapshot, "unknown kind %s", reader.header.Kind)
+	}
+
+	return reader, nil
+}
+
+func (reader *SnapshotReader) Header() SnapshotHeader {
+	return reader.header
+}
+
+// Next returns the next entry in the snapshot, or io.EOF once every entry has
+// been read and the snapshot has been verified.
+func (reader *SnapshotReader) Next() (SnapshotEntry, error) {
+	if reader.done {
+		return SnapshotEntry{}, io.EOF
+	}
+
+	line, err := reader.readLine()
+	if err != nil {
+		return SnapshotEntry{}, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(line, &fields)
+	if err != nil {
+		return SnapshotEntry{}, errors.Wrapf(ErrInvalidSnapshot, "line %d", reader.entries+2)
+	}
+
+	if _, isTrailer := fields["checksum"]; isTrailer {
+		return SnapshotEntry{}, reader.verify(line)
+	}
+
+	var entry SnapshotEntry
+	err = json.Unmarshal(line, &entry)
+	if err != nil {
+		return SnapshotEntry{}, errors.Wrapf(ErrInvalidSnapshot, "line %d: %s", reader.entries+2, err)
+	}
+
+	if entry.Delete && reader.header.Kind != SnapshotKindDelta {
+		return SnapshotEntry{}, errors.Wrapf(ErrInvalidSnapshot, "line %d: only deltas can delete warrants", reader.entries+2)
+	}
+
+	reader.checksum.Write(line)
+	reader.entries++
+	return entry, nil
+}
+
+func (reader *SnapshotReader) verify(line []byte) error {
+	reader.done = true
+	var trailer snapshotTrailer
+	err := json.Unmarshal(line, &trailer)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSnapshot, "invalid trailer")
+	}
+
+	checksum := checksumPrefix + hex.EncodeToString(reader.checksum.Sum(nil))
+	if trailer.Entries != reader.entries || trailer.Checksum != checksum {
+		return ErrSnapshotChecksumMismatch
+	}
+
+	if _, err := reader.reader.ReadByte(); err != io.EOF {
+		return errors.Wrap(ErrInvalidSnapshot, "data after trailer")
+	}
+
+	return io.EOF
+}
+
+func (reader *SnapshotReader) readLine() ([]byte, error) {
+	line, err := reader.reader.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, errors.Wrap(ErrInvalidSnapshot, "unexpected end of snapshot")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading snapshot")
+	}
+
+	return line, nil
+}
+
+// EncodeWarrantSet writes warrants to w as a snapshot.
+func EncodeWarrantSet(w io.Writer, warrants WarrantSet, syncedAt time.Time) error {
+	writer, err := NewSnapshotWriter(w, syncedAt)
+	if err != nil {
+		return err
+	}
+
+	for key, count := range warrants {
+		err := writer.Write(key, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// DecodeWarrantSet reads a snapshot from r, returning its warrants and when
+// they were last synced.
+func DecodeWarrantSet(r io.Reader) (WarrantSet, time.Time, error) {
+	reader, err := NewSnapshotReader(r)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if reader.Header().Kind == SnapshotKindDelta {
+		return nil, time.Time{}, errors.Wrap(ErrInvalidSnapshot, "expected a snapshot but got a delta")
+	}
+
+	warrants := make(WarrantSet)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return warrants, reader.Header().SyncedAt, nil
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		warrants[entry.Warrant] = entry.Count
+	}
+}
+
+// DecodeDelta reads a delta from r, returning the warrants it adds and
+// deletes and when they were synced.
+func DecodeDelta(r io.Reader) (WarrantSet, WarrantSet, time.Time, error) {
+	reader, err := NewSnapshotReader(r)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	if reader.Header().Kind != SnapshotKindDelta {
+		return nil, nil, time.Time{}, errors.Wrap(ErrInvalidSnapshot, "expected a delta but got a snapshot")
+	}
+
+	added := make(WarrantSet)
+	deleted := make(WarrantSet)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return added, deleted, reader.Header().SyncedAt, nil
+		}
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+
+		if entry.Delete {
+			deleted[entry.Warrant] += entry.Count
+		} else {
+			added[entry.Warrant] += entry.Count
+		}
+	}
+}
+
+// ExportSnapshot writes every warrant in repo to w as a snapshot.
+func ExportSnapshot(w io.Writer, repo IExportableRepository) error {
+	lastSynced, err := repo.LastSynced()
+	if err != nil {
+		return errors.Wrap(err, "error getting last synced time")
+	}
+
+	writer, err := NewSnapshotWriter(w, lastSynced)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Range(writer.Write)
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// ImportSnapshot replaces the warrants in repo with those in the snapshot read
+// from r, leaving repo unchanged if the snapshot is invalid.
+func ImportSnapshot(r io.Reader, repo IRepository) error {
+	warrants, syncedAt, err := DecodeWarrantSet(r)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Update(warrants)
+	if err != nil {
+		return errors.Wrap(err, "error loading snapshot into repository")
+	}
+
+	return repo.SetLastSynced(syncedAt)
+}
+
+// IsSnapshot reports whether data, such as the first bytes of a file, starts
+// like a snapshot rather than plain JSON.
+func IsSnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+}
+
+// exportSnapshot streams a snapshot of the repository of the environment a
+// request is for.
+func (server *Server) exportSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	repo, ok := server.repository(r.Context()).(IExportableRepository)
+	if !ok {
+		service.SendErrorResponse(w, service.NewInternalError("Repository cannot be exported"))
+		return
+	}
+
+	if !repo.Ready() {
+		service.SendErrorResponse(w, NewCacheNotReady())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot.jsonl.gz"`)
+	err := ExportSnapshot(w, repo)
+	if err != nil {
+		// the response has already started, so the client will see a
+		// truncated snapshot, which readers reject
+		log.Println(errors.Wrap(err, "error exporting snapshot"))
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warrant-dev/warrant/pkg/service"
+)
+
+const HeaderTenant = "Warrant-Tenant"
+
+var (
+	ErrMissingTenantName   = errors.New("missing tenant name")
+	ErrDuplicateTenantName = errors.New("duplicate tenant name")
+	ErrMissingRepository   = errors.New("missing repository")
+)
+
+type TenantConfig struct {
+	Name          string
+	ApiKey        string
+	ClientApiKeys []string
+	Repository    IRepository
+	Upstream      *Upstream
+	Client        *Client
+}
+
+// Tenant is one of the environments served by a multi-tenant agent, each
+// synced into its own repository.
+type Tenant struct {
+	config        TenantConfig
+	lock          sync.RWMutex
+	checks        atomic.Uint64
+	authorized    atomic.Uint64
+	notAuthorized atomic.Uint64
+}
+
+func NewTenant(config TenantConfig) (*Tenant, error) {
+	if config.Name == "" {
+		return nil, ErrMissingTenantName
+	}
+
+	if config.Repository == nil {
+		return nil, errors.Wrapf(ErrMissingRepository, "tenant %s", config.Name)
+	}
+
+	return &Tenant{
+		config: config,
+	}, nil
+}
+
+func (tenant *Tenant) Name() string {
+	return tenant.config.Name
+}
+
+// SetApiKeys rotates the API keys that may be used to make requests to the
+// tenant.
+func (tenant *Tenant) SetApiKeys(apiKey string, clientApiKeys []string) {
+	tenant.lock.Lock()
+	defer tenant.lock.Unlock()
+	tenant.config.ApiKey = apiKey
+	tenant.config.ClientApiKeys = clientApiKeys
+}
+
+func (tenant *Tenant) apiKeys() []string {
+	tenant.lock.RLock()
+	defer tenant.lock.RUnlock()
+	apiKeys := make([]string, 0)
+	if tenant.config.ApiKey != "" {
+		apiKeys = append(apiKeys, tenant.config.ApiKey)
+	}
+
+	return append(apiKeys, tenant.config.ClientApiKeys...)
+}
+
+// recordCheck counts a check answered for the tenant.
+func (tenant *Tenant) recordCheck(authorized bool) {
+	tenant.checks.Add(1)
+	if authorized {
+		tenant.authorized.Add(1)
+	} else {
+		tenant.notAuthorized.Add(1)
+	}
+}
+
+// TenantStatusSpec reports the readiness and activity of a tenant.
+type TenantStatusSpec struct {
+	Name          string     `json:"name"`
+	Ready         bool       `json:"ready"`
+	Datastore     string     `json:"datastore"`
+	LastSyncedAt  *time.Time `json:"lastSyncedAt,omitempty"`
+	Version       uint64     `json:"version,omitempty"`
+	Checks        uint64     `json:"checks"`
+	Authorized    uint64     `json:"authorized"`
+	NotAuthorized uint64     `json:"notAuthorized"`
+	Rejected      uint64     `json:"rejected,omitempty"`
+}
+
+func (tenant *Tenant) Status() TenantStatusSpec {
+	status := TenantStatusSpec{
+		Name:          tenant.config.Name,
+		Ready:         tenant.config.Repository.Ready(),
+		Datastore:     tenant.config.Repository.Datastore(),
+		Checks:        tenant.checks.Load(),
+		Authorized:    tenant.authorized.Load(),
+		NotAuthorized: tenant.notAuthorized.Load(),
+	}
+	if tenant.config.Client != nil {
+		status.Rejected = tenant.config.Client.Rejected()
+	}
+
+	lastSynced, err := tenant.config.Repository.LastSynced()
+	if err != nil {
+		log.Println(errors.Wrapf(err, "error getting last synced time of tenant %s", tenant.config.Name))
+	} else if !lastSynced.IsZero() {
+		status.LastSyncedAt = &lastSynced
+	}
+
+	version, err := tenant.config.Repository.Version()
+	if err != nil {
+		log.Println(errors.Wrapf(err, "error getting version of tenant %s", tenant.config.Name))
+	} else {
+		status.Version = version
+	}
+
+	return status
+}
+
+type tenantContextKey struct{}
+
+type bypassLocalCacheKey struct{}
+
+// withoutLocalCache makes lookups in the repository bypass its local cache, if
+// any, whose entries may have been cached at different times.
+func withoutLocalCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassLocalCacheKey{}, true)
+}
+
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+func tenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// resolveTenant returns the tenant a request is for. A tenant's API keys are
+// only valid for that tenant.
+func (server *Server) resolveTenant(name string, apiKey string) (*Tenant, error) {
+	if name != "" {
+		tenant, ok := server.tenants[name]
+		if !ok {
+			// don't reveal which tenants exist to unauthenticated callers
+			if !server.config.DisableAuth && !containsApiKey(server.apiKeys(), apiKey) {
+				return nil, service.NewUnauthorizedError("Invalid API key")
+			}
+
+			return nil, service.NewRecordNotFoundError("Tenant", name)
+		}
+
+		if !server.config.DisableAuth && !containsApiKey(server.apiKeys(), apiKey) && !containsApiKey(tenant.apiKeys(), apiKey) {
+			return nil, service.NewUnauthorizedError("Invalid API key")
+		}
+
+		return tenant, nil
+	}
+
+	if apiKey != "" {
+		for _, tenant := range server.config.Tenants {
+			if containsApiKey(tenant.apiKeys(), apiKey) {
+				return tenant, nil
+			}
+		}
+	}
+
+	if !server.config.DisableAuth && !containsApiKey(server.apiKeys(), apiKey) {
+		return nil, service.NewUnauthorizedError("Invalid API key")
+	}
+
+	return nil, service.NewMissingRequiredParameterError(HeaderTenant)
+}
+
+// routeTenant routes requests on the admin port, which are not authenticated,
+// to the tenant named in their path or Warrant-Tenant header.
+func (server *Server) routeTenant(next http.Handler) http.Handler {
+	if len(server.config.Tenants) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("tenant")
+		if name == "" {
+			name = r.Header.Get(HeaderTenant)
+		}
+
+		if name == "" {
+			service.SendErrorResponse(w, service.NewMissingRequiredParameterError(HeaderTenant))
+			return
+		}
+
+		tenant, ok := server.tenants[name]
+		if !ok {
+			service.SendErrorResponse(w, service.NewRecordNotFoundError("Tenant", name))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+// tenantMiddleware authenticates requests to a multi-tenant agent and routes
+// them to their tenant.
+func (server *Server) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("tenant")
+		if name == "" {
+			name = r.Header.Get(HeaderTenant)
+		}
+
+		apiKey := ""
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			var err error
+			apiKey, err = parseApiKey(authorization)
+			if err != nil {
+				service.SendErrorResponse(w, service.NewUnauthorizedError(fmt.Sprintf("Invalid authorization header: %s", err)))
+				return
+			}
+		}
+
+		tenant, err := server.resolveTenant(name, apiKey)
+		if err != nil {
+			service.SendErrorResponse(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+func (server *Server) tenantStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	statuses := make([]TenantStatusSpec, len(server.config.Tenants))
+	for i, tenant := range server.config.Tenants {
+		statuses[i] = tenant.Status()
+	}
+
+	service.SendJSONResponse(w, statuses)
+}
+
+// repository returns the repository of the tenant a request is for, or the
+// agent's repository if it serves a single environment.
+func (server *Server) repository(ctx context.Context) IRepository {
+	repo := server.config.Repository
+	if tenant := tenantFromContext(ctx); tenant != nil {
+		repo = tenant.config.Repository
+	}
+
+	if cachedRepo, ok := repo.(*CachedRepository); ok && ctx.Value(bypassLocalCacheKey{}) != nil {
+		return cachedRepo.repository
+	}
+
+	return repo
+}
+
+func (server *Server) upstream(ctx context.Context) *Upstream {
+	if tenant := tenantFromContext(ctx); tenant != nil {
+		return tenant.config.Upstream
+	}
+
+	return server.config.Upstream
+}
+
+// ready reports whether the repository of every environment the agent serves
+// is ready.
+func (server *Server) ready() bool {
+	if len(server.config.Tenants) == 0 {
+		return server.config.Repository.Ready()
+	}
+
+	for _, tenant := range server.config.Tenants {
+		if !tenant.config.Repository.Ready() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (server *Server) recordCheck(ctx context.Context, authorized bool) {
+	if tenant := tenantFromContext(ctx); tenant != nil {
+		tenant.recordCheck(authorized)
+	}
+}
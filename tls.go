@@ -0,0 +1,147 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const certReloadInterval = 10 * time.Second
+
+var ErrInvalidClientCA = errors.New("no certificates found in client CA file")
+
+// certReloader serves a certificate/key pair from disk, reloading it when
+// either file changes so that certificates can be rotated without a restart.
+type certReloader struct {
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+	lock        sync.Mutex
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	err = reloader.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	if time.Since(reloader.lastChecked) < certReloadInterval {
+		return reloader.cert, nil
+	}
+
+	reloader.lastChecked = time.Now()
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		log.Println(errors.Wrap(err, "error checking TLS certificate for changes"))
+		return reloader.cert, nil
+	}
+
+	if modTime.After(reloader.modTime) {
+		err = reloader.load(modTime)
+		if err != nil {
+			// keep serving the previous certificate until a valid one is written
+			log.Println(errors.Wrap(err, "error reloading TLS certificate"))
+		} else {
+			log.Printf("Reloaded TLS certificate %s", reloader.certFile)
+		}
+	}
+
+	return reloader.cert, nil
+}
+
+func (reloader *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS certificate")
+	}
+
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	reloader.lastChecked = time.Now()
+	return nil
+}
+
+func (reloader *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "error reading %s", file)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// newTLSConfig serves the given certificate, requiring client certificates if
+// clientCAFile is set.
+func newTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA file")
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidClientCA
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureFileExtension is appended to the name of an update file to get the
+// name of the file holding its base64-encoded Ed25519 signature.
+const SignatureFileExtension = ".sig"
+
+var (
+	ErrUpdateVersionGap      = errors.New("missing update version")
+	ErrUpdateVersionMismatch = errors.New("update file version mismatch")
+)
+
+// updateFileName matches update files named after the version they bring the
+// repository to, such as 12.snapshot.gz or 13.delta.gz.
+var updateFileName = regexp.MustCompile(`^(\d+)\.(snapshot|delta)\.gz$`)
+
+type updateFile struct {
+	path    string
+	version uint64
+	delta   bool
+}
+
+// listUpdateFiles returns the update files in dir ordered by version, with a
+// snapshot ahead of a delta of the same version.
+func listUpdateFiles(dir string) ([]updateFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]updateFile, 0)
+	for _, entry := range entries {
+		match := updateFileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, updateFile{
+			path:    filepath.Join(dir, entry.Name()),
+			version: version,
+			delta:   match[2] == "delta",
+		})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].version != files[j].version {
+			return files[i].version < files[j].version
+		}
+
+		return !files[i].delta && files[j].delta
+	})
+	return files, nil
+}
+
+// initializeFromFiles brings the repository up to date from the update files,
+// starting from the version it is at, which is kept along with its warrants.
+func (client *Client) initializeFromFiles() error {
+	err := client.applyUpdateFiles()
+	if err != nil {
+		// keep watching for files that can be applied
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// watch applies new update files until ctx is cancelled.
+func (client *Client) watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * time.Duration(client.pollingFrequency())):
+		}
+
+		err := client.applyUpdateFiles()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// applyUpdateFiles applies the newest snapshot ahead of the repository, if
+// any, and each following delta.
+func (client *Client) applyUpdateFiles() error {
+	version, err := client.config.Repository.Version()
+	if err != nil {
+		return errors.Wrap(err, "error getting version")
+	}
+
+	files, err := listUpdateFiles(client.config.UpdateDirectory)
+	if err != nil {
+		return errors.Wrap(err, "error listing update files")
+	}
+
+	start := 0
+	for i, file := range files {
+		if !file.delta && file.version > version {
+			start = i
+		}
+	}
+
+	for _, file := range files[start:] {
+		if file.version <= version {
+			continue
+		}
+
+		if file.delta && (version == 0 || file.version != version+1) {
+			return errors.Wrapf(ErrUpdateVersionGap, "cannot apply %s to version %d, waiting for a snapshot", file.path, version)
+		}
+
+		err := client.applyUpdateFile(file, version)
+		if errors.Is(err, ErrVersionConflict) {
+			// another agent sharing the repository applied an update first,
+			// so pick up from the version it left the repository at
+			log.Printf("Skipped %s, the repository was updated by another agent", file.path)
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrUpdateVersionMismatch) {
+				client.rejected.Add(1)
+			}
+
+			return errors.Wrapf(err, "rejected %s", file.path)
+		}
+
+		version = file.version
+		log.Printf("Applied %s, now at version %d", file.path, version)
+	}
+
+	if version > 0 {
+		client.config.Repository.SetReady(true)
+	}
+
+	return nil
+}
+
+// applyUpdateFile verifies an update file and applies it to the repository at
+// version.
+func (client *Client) applyUpdateFile(file updateFile, version uint64) error {
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return err
+	}
+
+	signature, err := os.ReadFile(file.path + SignatureFileExtension)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrInvalidSignature, "missing signature")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = VerifySignature(client.config.PublicKey, data, string(signature))
+	if err != nil {
+		return err
+	}
+
+	reader, err := NewSnapshotReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	header := reader.Header()
+	if header.UpdateVersion != file.version {
+		return errors.Wrapf(ErrUpdateVersionMismatch, "signed for version %d", header.UpdateVersion)
+	}
+
+	if file.delta && header.BaseVersion != version {
+		return errors.Wrapf(ErrUpdateVersionMismatch, "signed for a repository at version %d, repository is at version %d", header.BaseVersion, version)
+	}
+
+	syncedAt := header.SyncedAt
+	if syncedAt.IsZero() {
+		syncedAt = time.Now()
+	}
+
+	if file.delta {
+		added, deleted, _, err := DecodeDelta(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		return client.config.Repository.(IDeltaRepository).ApplyDelta(Delta{
+			BaseVersion: version,
+			Version:     file.version,
+			Added:       client.config.ObjectTypes.Filter(added),
+			Deleted:     client.config.ObjectTypes.Filter(deleted),
+			SyncedAt:    syncedAt,
+		})
+	}
+
+	warrants, _, err := DecodeWarrantSet(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	loader, err := client.config.Repository.Load()
+	if err != nil {
+		return errors.Wrap(err, "error staging warrants")
+	}
+
+	err = loader.Add(client.config.ObjectTypes.Filter(warrants))
+	if err == nil {
+		err = loader.CommitVersion(version, file.version, syncedAt)
+	}
+	if err != nil {
+		if discardErr := loader.Discard(); discardErr != nil {
+			log.Println(errors.Wrap(discardErr, "error discarding staged warrants"))
+		}
+
+		return err
+	}
+
+	return nil
+}
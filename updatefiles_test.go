@@ -0,0 +1,285 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestApplyUpdateFiles(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := benchmarkKey(1), benchmarkKey(2)
+	newClient := func(t *testing.T) (*Client, IRepository, string) {
+		dir := t.TempDir()
+		repo := NewMemoryRepository()
+		client := &Client{config: ClientConfig{
+			UpdateDirectory: dir,
+			PublicKey:       publicKey,
+			Repository:      repo,
+		}}
+		return client, repo, dir
+	}
+
+	t.Run("snapshot then delta", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		writeTestUpdateFile(t, dir, privateKey, "1.snapshot.gz", false, 0, 1, WarrantSet{first: 1})
+		writeTestUpdateFile(t, dir, privateKey, "2.delta.gz", true, 1, 2, WarrantSet{second: 1})
+
+		err := client.applyUpdateFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectVersion(t, repo, 2)
+		expectWarrants(t, repo, first, second)
+	})
+
+	t.Run("delta without snapshot", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		writeTestUpdateFile(t, dir, privateKey, "1.delta.gz", true, 0, 1, WarrantSet{first: 1})
+
+		err := client.applyUpdateFiles()
+		if !errors.Is(err, ErrUpdateVersionGap) {
+			t.Fatalf("expected ErrUpdateVersionGap, got %v", err)
+		}
+		expectVersion(t, repo, 0)
+	})
+
+	t.Run("renamed snapshot", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		writeTestUpdateFile(t, dir, privateKey, "5.snapshot.gz", false, 0, 1, WarrantSet{first: 1})
+
+		err := client.applyUpdateFiles()
+		if !errors.Is(err, ErrUpdateVersionMismatch) {
+			t.Fatalf("expected ErrUpdateVersionMismatch, got %v", err)
+		}
+		if client.Rejected() != 1 {
+			t.Fatalf("expected 1 rejected, got %d", client.Rejected())
+		}
+		expectVersion(t, repo, 0)
+		expectWarrants(t, repo)
+	})
+
+	t.Run("renamed delta", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		writeTestUpdateFile(t, dir, privateKey, "1.snapshot.gz", false, 0, 1, WarrantSet{first: 1})
+		writeTestUpdateFile(t, dir, privateKey, "2.delta.gz", true, 2, 3, WarrantSet{second: 1})
+
+		err := client.applyUpdateFiles()
+		if !errors.Is(err, ErrUpdateVersionMismatch) {
+			t.Fatalf("expected ErrUpdateVersionMismatch, got %v", err)
+		}
+		if client.Rejected() != 1 {
+			t.Fatalf("expected 1 rejected, got %d", client.Rejected())
+		}
+		expectVersion(t, repo, 1)
+		expectWarrants(t, repo, first)
+	})
+
+	t.Run("delta from another base", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		writeTestUpdateFile(t, dir, privateKey, "1.snapshot.gz", false, 0, 1, WarrantSet{first: 1})
+		writeTestUpdateFile(t, dir, privateKey, "2.delta.gz", true, 0, 2, WarrantSet{second: 1})
+
+		err := client.applyUpdateFiles()
+		if !errors.Is(err, ErrUpdateVersionMismatch) {
+			t.Fatalf("expected ErrUpdateVersionMismatch, got %v", err)
+		}
+		if client.Rejected() != 1 {
+			t.Fatalf("expected 1 rejected, got %d", client.Rejected())
+		}
+		expectVersion(t, repo, 1)
+		expectWarrants(t, repo, first)
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		client, repo, dir := newClient(t)
+		_, otherKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestUpdateFile(t, dir, otherKey, "1.snapshot.gz", false, 0, 1, WarrantSet{first: 1})
+
+		err = client.applyUpdateFiles()
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("expected ErrInvalidSignature, got %v", err)
+		}
+		if client.Rejected() != 1 {
+			t.Fatalf("expected 1 rejected, got %d", client.Rejected())
+		}
+		expectVersion(t, repo, 0)
+	})
+}
+
+func TestApplyDeltaVersionConflict(t *testing.T) {
+	repo := NewMemoryRepository()
+	err := repo.ApplyDelta(Delta{BaseVersion: 0, Version: 1, Added: WarrantSet{}, Deleted: WarrantSet{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delta := Delta{
+		BaseVersion: 1,
+		Version:     2,
+		Added:       WarrantSet{benchmarkKey(1): 1},
+		Deleted:     WarrantSet{},
+		SyncedAt:    time.Now(),
+	}
+	err = repo.ApplyDelta(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// applying the same delta again, as a second agent sharing the
+	// repository would, must not count the warrant twice
+	err = repo.ApplyDelta(delta)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+
+	expectVersion(t, repo, 2)
+
+	// so deleting it once removes it
+	err = repo.ApplyDelta(Delta{
+		BaseVersion: 2,
+		Version:     3,
+		Added:       WarrantSet{},
+		Deleted:     WarrantSet{benchmarkKey(1): 1},
+		SyncedAt:    time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWarrants(t, repo)
+	expectVersion(t, repo, 3)
+}
+
+// writeTestUpdateFile writes an update file named name to dir, signed with
+// privateKey for the given versions, adding warrants.
+func writeTestUpdateFile(t *testing.T, dir string, privateKey ed25519.PrivateKey, name string, delta bool, baseVersion uint64, version uint64, warrants WarrantSet) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var writer *SnapshotWriter
+	var err error
+	if delta {
+		writer, err = NewUpdateDeltaWriter(&buf, time.Now(), baseVersion, version)
+	} else {
+		writer, err = NewUpdateSnapshotWriter(&buf, time.Now(), version)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, count := range warrants {
+		err := writer.Write(key, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	err = os.WriteFile(path, buf.Bytes(), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, buf.Bytes()))
+	err = os.WriteFile(path+SignatureFileExtension, []byte(signature), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectVersion(t *testing.T, repo IRepository, expected uint64) {
+	t.Helper()
+
+	version, err := repo.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != expected {
+		t.Fatalf("expected version %d, got %d", expected, version)
+	}
+}
+
+// expectWarrants checks that the repository holds exactly the given warrants
+// out of the test keys.
+func expectWarrants(t *testing.T, repo IRepository, expected ...WarrantKey) {
+	t.Helper()
+
+	keys := []WarrantKey{benchmarkKey(1), benchmarkKey(2)}
+	warrants, err := repo.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[WarrantKey]bool)
+	for _, key := range expected {
+		found[key] = true
+	}
+	for i, key := range keys {
+		if warrants[i] != found[key] {
+			t.Errorf("%s: expected present %t, got %t", key, found[key], warrants[i])
+		}
+	}
+}
+
+func TestCommitVersionConflict(t *testing.T) {
+	repo := NewMemoryRepository()
+	err := repo.ApplyDelta(Delta{BaseVersion: 0, Version: 1, Added: WarrantSet{benchmarkKey(1): 1}, Deleted: WarrantSet{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot staged against version 0 must not replace the repository
+	// another agent has since brought to version 1
+	loader, err := repo.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loader.Add(WarrantSet{benchmarkKey(2): 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loader.CommitVersion(0, 2, time.Now())
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	expectWarrants(t, repo, benchmarkKey(1))
+	expectVersion(t, repo, 1)
+
+	err = loader.CommitVersion(1, 2, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWarrants(t, repo, benchmarkKey(2))
+	expectVersion(t, repo, 2)
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+)
+
+const (
+	DefaultUpstreamTimeout          = 2 * time.Second
+	DefaultUpstreamFailureThreshold = 5
+	DefaultUpstreamResetTimeout     = 30 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+type UpstreamConfig struct {
+	ApiKey           string
+	ApiEndpoint      string
+	Timeout          time.Duration
+	FailureThreshold int
+	ResetTimeout     time.Duration
+}
+
+// Upstream forwards checks to the Warrant API, pausing for ResetTimeout after
+// FailureThreshold consecutive failures.
+type Upstream struct {
+	config     UpstreamConfig
+	httpClient *http.Client
+	breaker    *circuitBreaker
+	lock       sync.RWMutex
+}
+
+func NewUpstream(conf UpstreamConfig) (*Upstream, error) {
+	config := UpstreamConfig{
+		ApiEndpoint:      DefaultApiEndpoint,
+		Timeout:          DefaultUpstreamTimeout,
+		FailureThreshold: DefaultUpstreamFailureThreshold,
+		ResetTimeout:     DefaultUpstreamResetTimeout,
+	}
+
+	if conf.ApiKey == "" {
+		return nil, ErrMissingApiKey
+	} else {
+		config.ApiKey = conf.ApiKey
+	}
+
+	if conf.ApiEndpoint != "" {
+		config.ApiEndpoint = conf.ApiEndpoint
+	}
+
+	if conf.Timeout != 0 {
+		config.Timeout = conf.Timeout
+	}
+
+	if conf.FailureThreshold != 0 {
+		config.FailureThreshold = conf.FailureThreshold
+	}
+
+	if conf.ResetTimeout != 0 {
+		config.ResetTimeout = conf.ResetTimeout
+	}
+
+	return &Upstream{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: config.Timeout,
+		},
+		breaker: &circuitBreaker{
+			failureThreshold: config.FailureThreshold,
+			resetTimeout:     config.ResetTimeout,
+		},
+	}, nil
+}
+
+// SetApiKey rotates the API key checks are forwarded with.
+func (upstream *Upstream) SetApiKey(apiKey string) error {
+	if apiKey == "" {
+		return ErrMissingApiKey
+	}
+
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	upstream.config.ApiKey = apiKey
+	return nil
+}
+
+func (upstream *Upstream) apiKey() string {
+	upstream.lock.RLock()
+	defer upstream.lock.RUnlock()
+	return upstream.config.ApiKey
+}
+
+func (upstream *Upstream) Check(ctx context.Context, checkManySpec check.CheckManySpec) (*check.CheckResultSpec, error) {
+	if !upstream.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	checkResult, err := upstream.check(ctx, checkManySpec)
+	if err != nil {
+		// a request given up on by its caller says nothing about the upstream
+		if ctx.Err() == nil {
+			upstream.breaker.Failure()
+		}
+		return nil, err
+	}
+
+	upstream.breaker.Success()
+	return checkResult, nil
+}
+
+func (upstream *Upstream) check(ctx context.Context, checkManySpec check.CheckManySpec) (*check.CheckResultSpec, error) {
+	postBody, err := json.Marshal(checkManySpec)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/check", upstream.config.ApiEndpoint, ApiVersion), bytes.NewBuffer(postBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating request object")
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", upstream.apiKey()))
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := upstream.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error making request to server")
+	}
+	defer resp.Body.Close()
+
+	respStatus := resp.StatusCode
+	if respStatus < 200 || respStatus >= 400 {
+		msg, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading response from server")
+		}
+
+		return nil, errors.New(fmt.Sprintf("received HTTP %d: %s", respStatus, string(msg)))
+	}
+
+	var checkResult check.CheckResultSpec
+	err = json.NewDecoder(resp.Body).Decode(&checkResult)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading response from server")
+	}
+
+	return &checkResult, nil
+}
+
+type circuitBreaker struct {
+	failureThreshold int
+	resetTimeout     time.Duration
+	failures         int
+	openedAt         time.Time
+	lock             sync.Mutex
+}
+
+// Allow reports whether a request may be attempted.
+func (breaker *circuitBreaker) Allow() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	if breaker.failures < breaker.failureThreshold {
+		return true
+	}
+
+	return time.Since(breaker.openedAt) >= breaker.resetTimeout
+}
+
+func (breaker *circuitBreaker) Success() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.failures = 0
+}
+
+func (breaker *circuitBreaker) Failure() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.failures++
+	if breaker.failures >= breaker.failureThreshold {
+		breaker.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+)
+
+func TestUpstreamCanceledChecksDontOpenBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	upstream, err := NewUpstream(UpstreamConfig{
+		ApiKey:           "key",
+		ApiEndpoint:      server.URL,
+		FailureThreshold: 2,
+		ResetTimeout:     time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one real failure, then checks canceled by their callers
+	_, err = upstream.Check(context.Background(), check.CheckManySpec{})
+	if err == nil {
+		t.Fatal("expected check to fail")
+	}
+
+	failing.Store(false)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = upstream.Check(ctx, check.CheckManySpec{})
+		cancel()
+		if errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected canceled checks not to open the breaker, opened after %d", i+1)
+		}
+		if err == nil {
+			t.Fatal("expected check to be canceled")
+		}
+	}
+
+	failing.Store(true)
+	_, err = upstream.Check(context.Background(), check.CheckManySpec{})
+	if err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected check to reach the upstream and fail, got %v", err)
+	}
+
+	_, err = upstream.Check(context.Background(), check.CheckManySpec{})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected breaker to open after two failures, got %v", err)
+	}
+}
@@ -14,11 +14,41 @@
 
 package edge
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
 
-type WarrantSet map[string]uint16
+	"github.com/pkg/errors"
+	check "github.com/warrant-dev/warrant/pkg/authz/check"
+	warrant "github.com/warrant-dev/warrant/pkg/authz/warrant"
+)
 
-func (set WarrantSet) Add(key string) {
+var ErrInvalidWarrantKey = errors.New("invalid warrant key")
+
+// keyEscaper escapes the characters that delimit the parts of a warrant key,
+// and keyUnescaper reverses it.
+var (
+	keyEscaper = strings.NewReplacer(
+		"%", "%25",
+		":", "%3A",
+		"#", "%23",
+		"@", "%40",
+		"[", "%5B",
+		"]", "%5D",
+	)
+	keyUnescaper = strings.NewReplacer(
+		"%25", "%",
+		"%3A", ":",
+		"%23", "#",
+		"%40", "@",
+		"%5B", "[",
+		"%5D", "]",
+	)
+)
+
+type WarrantSet map[WarrantKey]uint16
+
+func (set WarrantSet) Add(key WarrantKey) {
 	if count, ok := set[key]; ok {
 		set[key] = count + 1
 		return
@@ -27,12 +57,12 @@ func (set WarrantSet) Add(key string) {
 	set[key] = 1
 }
 
-func (set WarrantSet) Has(key string) bool {
+func (set WarrantSet) Has(key WarrantKey) bool {
 	_, exists := set[key]
 	return exists
 }
 
-func (set WarrantSet) Get(key string) uint16 {
+func (set WarrantSet) Get(key WarrantKey) uint16 {
 	return set[key]
 }
 
@@ -44,3 +74,215 @@ func (set WarrantSet) String() string {
 
 	return str
 }
+
+// WarrantKey identifies a warrant in the repository. It is encoded as
+// "objectType:objectId#relation@subjectType:subjectId[#subjectRelation]",
+// followed by "[policy]" if the warrant has a policy.
+type WarrantKey struct {
+	ObjectType string
+	ObjectId   string
+	Relation   string
+	Subject    SubjectKey
+	Policy     warrant.Policy
+}
+
+// NewWarrantKey returns the key of the warrant a check looks up, which
+// excludes the check's context.
+func NewWarrantKey(spec check.CheckWarrantSpec) WarrantKey {
+	key := WarrantKey{
+		ObjectType: spec.ObjectType,
+		ObjectId:   spec.ObjectId,
+		Relation:   spec.Relation,
+	}
+	if spec.Subject != nil {
+		key.Subject = SubjectKey{
+			ObjectType: spec.Subject.ObjectType,
+			ObjectId:   spec.Subject.ObjectId,
+			Relation:   spec.Subject.Relation,
+		}
+	}
+
+	return key
+}
+
+// ParseWarrantKey decodes a warrant key, accepting both the escaped encoding
+// produced by WarrantKey.String and the unescaped one used by the Warrant API.
+func ParseWarrantKey(str string) (WarrantKey, error) {
+	var key WarrantKey
+	tuple := str
+	if policyStart := strings.Index(str, "["); policyStart != -1 {
+		if !strings.HasSuffix(str, "]") {
+			return WarrantKey{}, errors.Wrapf(ErrInvalidWarrantKey, "%s", str)
+		}
+
+		tuple = str[:policyStart]
+		key.Policy = warrant.Policy(str[policyStart+1 : len(str)-1])
+	}
+
+	// object types and relations cannot contain ":", "#" or "@" and object
+	// ids cannot contain "#", so the first of each delimits the parts
+	typeEnd := strings.Index(tuple, ":")
+	relationStart := strings.Index(tuple, "#")
+	if typeEnd <= 0 || relationStart <= typeEnd+1 {
+		return WarrantKey{}, errors.Wrapf(ErrInvalidWarrantKey, "%s", str)
+	}
+
+	subjectStart := strings.Index(tuple[relationStart:], "@")
+	if subjectStart <= 1 {
+		return WarrantKey{}, errors.Wrapf(ErrInvalidWarrantKey, "%s", str)
+	}
+	subjectStart += relationStart
+
+	subject, err := ParseSubjectKey(tuple[subjectStart+1:])
+	if err != nil {
+		return WarrantKey{}, errors.Wrapf(ErrInvalidWarrantKey, "%s", str)
+	}
+
+	key.ObjectType = keyUnescaper.Replace(tuple[:typeEnd])
+	key.ObjectId = keyUnescaper.Replace(tuple[typeEnd+1 : relationStart])
+	key.Relation = keyUnescaper.Replace(tuple[relationStart+1 : subjectStart])
+	key.Subject = subject
+	return key, nil
+}
+
+func (key WarrantKey) String() string {
+	str := fmt.Sprintf("%s@%s", key.ObjectRelation(), key.Subject)
+	if key.Policy != "" {
+		str = fmt.Sprintf("%s[%s]", str, key.Policy)
+	}
+
+	return str
+}
+
+func (key WarrantKey) MarshalText() ([]byte, error) {
+	return []byte(key.String()), nil
+}
+
+func (key *WarrantKey) UnmarshalText(text []byte) error {
+	parsed, err := ParseWarrantKey(string(text))
+	if err != nil {
+		return err
+	}
+
+	*key = parsed
+	return nil
+}
+
+// ObjectRelation encodes the object and relation of the key, such as
+// "document:1#viewer".
+func (key WarrantKey) ObjectRelation() string {
+	return fmt.Sprintf("%s:%s#%s", keyEscaper.Replace(key.ObjectType), keyEscaper.Replace(key.ObjectId), keyEscaper.Replace(key.Relation))
+}
+
+// IsUserset reports whether the warrant is granted to a userset, such as the
+// members of a group, rather than a single subject.
+func (key WarrantKey) IsUserset() bool {
+	return key.Subject.Relation != ""
+}
+
+// WithoutPolicy returns the key of the warrant a policy applies to.
+func (key WarrantKey) WithoutPolicy() WarrantKey {
+	key.Policy = ""
+	return key
+}
+
+// WithWildcardObject returns the key of the warrant granting the same
+// relation on every object of the key's type.
+func (key WarrantKey) WithWildcardObject() WarrantKey {
+	key.ObjectId = warrant.Wildcard
+	return key
+}
+
+// Spec returns the warrant the key identifies.
+func (key WarrantKey) Spec() warrant.WarrantSpec {
+	return warrant.WarrantSpec{
+		ObjectType: key.ObjectType,
+		ObjectId:   key.ObjectId,
+		Relation:   key.Relation,
+		Subject:    key.Subject.Spec(),
+		Policy:     key.Policy,
+	}
+}
+
+// legacyString encodes the key the way agents did before keys were escaped.
+func (key WarrantKey) legacyString() string {
+	str := fmt.Sprintf("%s@%s", key.legacyObjectRelation(), key.Subject.legacyString())
+	if key.Policy != "" {
+		str = fmt.Sprintf("%s[%s]", str, key.Policy)
+	}
+
+	return str
+}
+
+func (key WarrantKey) legacyObjectRelation() string {
+	return fmt.Sprintf("%s:%s#%s", key.ObjectType, key.ObjectId, key.Relation)
+}
+
+func (key WarrantKey) legacyObjectsIndexKey() string {
+	return fmt.Sprintf("%s#%s@%s", key.ObjectType, key.Relation, key.Subject.legacyString())
+}
+
+// objectsIndexKey identifies the objects of the key's type on which its
+// subject has its relation, such as "document#viewer@user:1".
+func (key WarrantKey) objectsIndexKey() string {
+	return objectsIndexKey(key.ObjectType, key.Relation, key.Subject)
+}
+
+func objectsIndexKey(objectType string, relation string, subject SubjectKey) string {
+	return fmt.Sprintf("%s#%s@%s", keyEscaper.Replace(objectType), keyEscaper.Replace(relation), subject)
+}
+
+// SubjectKey identifies the subject of a warrant, which is a userset if it
+// has a relation.
+type SubjectKey struct {
+	ObjectType string
+	ObjectId   string
+	Relation   string
+}
+
+func ParseSubjectKey(str string) (SubjectKey, error) {
+	typeEnd := strings.Index(str, ":")
+	if typeEnd <= 0 || typeEnd == len(str)-1 {
+		return SubjectKey{}, errors.Wrapf(ErrInvalidWarrantKey, "invalid subject %s", str)
+	}
+
+	subject := SubjectKey{
+		ObjectType: keyUnescaper.Replace(str[:typeEnd]),
+		ObjectId:   keyUnescaper.Replace(str[typeEnd+1:]),
+	}
+	if relationStart := strings.Index(str[typeEnd:], "#"); relationStart != -1 {
+		relationStart += typeEnd
+		subject.ObjectId = keyUnescaper.Replace(str[typeEnd+1 : relationStart])
+		subject.Relation = keyUnescaper.Replace(str[relationStart+1:])
+	}
+
+	return subject, nil
+}
+
+func (subject SubjectKey) String() string {
+	str := fmt.Sprintf("%s:%s", keyEscaper.Replace(subject.ObjectType), keyEscaper.Replace(subject.ObjectId))
+	if subject.Relation != "" {
+		str = fmt.Sprintf("%s#%s", str, keyEscaper.Replace(subject.Relation))
+	}
+
+	return str
+}
+
+// legacyString encodes the subject without escaping its parts, the way agents
+// did before keys were escaped.
+func (subject SubjectKey) legacyString() string {
+	str := fmt.Sprintf("%s:%s", subject.ObjectType, subject.ObjectId)
+	if subject.Relation != "" {
+		str = fmt.Sprintf("%s#%s", str, subject.Relation)
+	}
+
+	return str
+}
+
+func (subject SubjectKey) Spec() *warrant.SubjectSpec {
+	return &warrant.SubjectSpec{
+		ObjectType: subject.ObjectType,
+		ObjectId:   subject.ObjectId,
+		Relation:   subject.Relation,
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 WorkOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package edge
+
+import (
+	"testing"
+)
+
+func TestParseWarrantKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     WarrantKey
+		encoded string
+		legacy  string
+	}{
+		{
+			name:    "plain ids",
+			key:     WarrantKey{ObjectType: "document", ObjectId: "1", Relation: "viewer", Subject: SubjectKey{ObjectType: "user", ObjectId: "1"}},
+			encoded: "document:1#viewer@user:1",
+			legacy:  "document:1#viewer@user:1",
+		},
+		{
+			name:    "ids with delimiters",
+			key:     WarrantKey{ObjectType: "document", ObjectId: "a:b@c", Relation: "viewer", Subject: SubjectKey{ObjectType: "user", ObjectId: "john@example.com"}},
+			encoded: "document:a%3Ab%40c#viewer@user:john%40example.com",
+			legacy:  "document:a:b@c#viewer@user:john@example.com",
+		},
+		{
+			name:    "userset with policy",
+			key:     WarrantKey{ObjectType: "document", ObjectId: "x@y", Relation: "viewer", Subject: SubjectKey{ObjectType: "group", ObjectId: "eng:1", Relation: "member"}, Policy: `tenant == "acme"`},
+			encoded: `document:x%40y#viewer@group:eng%3A1#member[tenant == "acme"]`,
+			legacy:  `document:x@y#viewer@group:eng:1#member[tenant == "acme"]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.key.String() != test.encoded {
+				t.Errorf("expected %s to be encoded as %s", test.key.String(), test.encoded)
+			}
+
+			if test.key.legacyString() != test.legacy {
+				t.Errorf("expected %s to be encoded as %s", test.key.legacyString(), test.legacy)
+			}
+
+			for _, str := range []string{test.encoded, test.legacy} {
+				key, err := ParseWarrantKey(str)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if key != test.key {
+					t.Errorf("expected %s to parse as %+v, got %+v", str, test.key, key)
+				}
+			}
+		})
+	}
+}